@@ -0,0 +1,761 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+// Keys which are not a printable character.
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyPageUp    = "pgup"
+	keyPageDown  = "pgdn"
+	keyHome      = "home"
+	keyEnd       = "end"
+	keyEnter     = "enter"
+	keyEscape    = "esc"
+	keyBackspace = "backspace"
+	keyCtrlC     = "ctrl-c"
+)
+
+// escapeSequences maps the escape sequences sent by the terminals to keys.
+var escapeSequences = map[string]string{
+	"\x1b[A":  keyUp,
+	"\x1bOA":  keyUp,
+	"\x1b[B":  keyDown,
+	"\x1bOB":  keyDown,
+	"\x1b[5~": keyPageUp,
+	"\x1b[6~": keyPageDown,
+	"\x1b[H":  keyHome,
+	"\x1bOH":  keyHome,
+	"\x1b[1~": keyHome,
+	"\x1b[F":  keyEnd,
+	"\x1bOF":  keyEnd,
+	"\x1b[4~": keyEnd,
+}
+
+// escapeTimeout is how long the rest of an escape sequence is waited for
+// before taking its first byte as the escape key.
+const escapeTimeout = 50 * time.Millisecond
+
+// escapeSequence returns the length of the CSI (ESC [ parameters final byte)
+// or SS3 (ESC O byte) sequence at the beginning of b, -1 if b only holds its
+// beginning and 0 if b does not start with one.
+func escapeSequence(b []byte) int {
+	if len(b) < 2 {
+		return -1
+	}
+	switch b[1] {
+	case 'O':
+		if len(b) < 3 {
+			return -1
+		}
+		return 3
+	case '[':
+		for i := 2; i < len(b); i++ {
+			switch c := b[i]; {
+			case c >= 0x40 && c <= 0x7e:
+				return i + 1
+			case c < 0x20 || c > 0x3f:
+				return 0
+			}
+		}
+		return -1
+	}
+	return 0
+}
+
+// parseKeys splits the bytes read from a terminal in raw mode into keys. An
+// escape sequence which may be incomplete is returned as rest to be parsed
+// with the next bytes read, unless final is set. The escape sequences of
+// unknown keys, e.g. the left arrow or the function keys, are skipped.
+func parseKeys(b []byte, final bool) (keys []string, rest []byte) {
+	for len(b) > 0 {
+		if b[0] == 0x1b {
+			n := escapeSequence(b)
+			if n < 0 && !final {
+				return keys, b
+			}
+			if n <= 0 {
+				keys = append(keys, keyEscape)
+				b = b[1:]
+				continue
+			}
+			if key, ok := escapeSequences[string(b[:n])]; ok {
+				keys = append(keys, key)
+			}
+			b = b[n:]
+			continue
+		}
+		switch b[0] {
+		case 0x03:
+			keys = append(keys, keyCtrlC)
+		case '\r', '\n':
+			keys = append(keys, keyEnter)
+		case 0x7f, 0x08:
+			keys = append(keys, keyBackspace)
+		default:
+			r, n := utf8.DecodeRune(b)
+			if r >= ' ' {
+				keys = append(keys, string(r))
+			}
+			b = b[n:]
+			continue
+		}
+		b = b[1:]
+	}
+	return keys, nil
+}
+
+// browseColumn is a column of the repository list, sortable if less is set.
+type browseColumn struct {
+	name  string
+	width int // the URL column takes the remaining width.
+	right bool
+	value func(r *pga.SivaRepository) string
+	less  func(a, b *pga.SivaRepository) bool
+}
+
+func formatCount(n int64) string {
+	if n < 0 {
+		return "-"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+var browseColumns = []browseColumn{
+	{
+		name:  "URL",
+		value: func(r *pga.SivaRepository) string { return r.URL },
+		less:  func(a, b *pga.SivaRepository) bool { return a.URL < b.URL },
+	},
+	{
+		name:  "LANGUAGES",
+		width: 24,
+		value: func(r *pga.SivaRepository) string { return strings.Join(r.Languages, ",") },
+	},
+	{
+		name:  "STARS",
+		width: 7,
+		right: true,
+		value: func(r *pga.SivaRepository) string { return formatCount(r.Stars) },
+		less:  func(a, b *pga.SivaRepository) bool { return a.Stars < b.Stars },
+	},
+	{
+		name:  "LICENSE",
+		width: 14,
+		value: func(r *pga.SivaRepository) string { return r.License },
+		less:  func(a, b *pga.SivaRepository) bool { return a.License < b.License },
+	},
+	{
+		name:  "SIZE",
+		width: 9,
+		right: true,
+		value: func(r *pga.SivaRepository) string {
+			if r.Size < 0 {
+				return "-"
+			}
+			return humanize.Bytes(uint64(r.Size))
+		},
+		less: func(a, b *pga.SivaRepository) bool { return a.Size < b.Size },
+	},
+	{
+		name:  "FILES",
+		width: 8,
+		right: true,
+		value: func(r *pga.SivaRepository) string { return formatCount(r.Files) },
+		less:  func(a, b *pga.SivaRepository) bool { return a.Files < b.Files },
+	},
+	{
+		name:  "COMMITS",
+		width: 8,
+		right: true,
+		value: func(r *pga.SivaRepository) string { return formatCount(r.Commits) },
+		less:  func(a, b *pga.SivaRepository) bool { return a.Commits < b.Commits },
+	},
+}
+
+// The filters which can be edited while browsing.
+const (
+	inputSearch = iota
+	inputLanguage
+	inputStars
+	inputLicense
+	numInputs
+)
+
+var inputLabels = [numInputs]string{"search", "language", "min stars", "license"}
+
+// inputKeys are the keys starting to edit each filter.
+var inputKeys = map[string]int{"/": inputSearch, "l": inputLanguage, "s": inputStars, "L": inputLicense}
+
+// detailHeight is the number of lines of the detail pane.
+const detailHeight = 8
+
+const browseHelp = "space mark  a all  / search  l lang  s stars  L license  x clear  " +
+	"o sort  r reverse  d download  q quit"
+
+// browser holds the state of pga browse. Only the repositories matching the
+// filters are visible, in the order of the sort column, or of the index if
+// it is negative.
+type browser struct {
+	title   string
+	repos   []*pga.SivaRepository
+	visible []*pga.SivaRepository
+	marked  map[*pga.SivaRepository]bool
+
+	inputs     [numInputs]string
+	editing    int // the filter being edited, or -1.
+	sortColumn int
+	desc       bool
+
+	cursor   int
+	top      int
+	pageSize int
+	status   string
+
+	done     bool
+	download bool
+}
+
+func newBrowser(title string, repos []*pga.SivaRepository) *browser {
+	b := &browser{
+		title:      title,
+		repos:      repos,
+		marked:     map[*pga.SivaRepository]bool{},
+		editing:    -1,
+		sortColumn: -1,
+		pageSize:   1,
+	}
+	b.refresh()
+	return b
+}
+
+func (b *browser) matches(r *pga.SivaRepository) bool {
+	if s := b.inputs[inputSearch]; s != "" && !strings.Contains(strings.ToLower(r.URL), strings.ToLower(s)) {
+		return false
+	}
+	if lang := strings.ToLower(b.inputs[inputLanguage]); lang != "" {
+		found := false
+		for _, l := range r.Languages {
+			if strings.HasPrefix(strings.ToLower(l), lang) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if s := b.inputs[inputStars]; s != "" {
+		if stars, err := strconv.ParseInt(s, 10, 64); err == nil && r.Stars < stars {
+			return false
+		}
+	}
+	if s := b.inputs[inputLicense]; s != "" && !strings.Contains(strings.ToLower(r.License), strings.ToLower(s)) {
+		return false
+	}
+	return true
+}
+
+// refresh computes the visible repositories, keeping the cursor on the same
+// repository if it is still visible.
+func (b *browser) refresh() {
+	var current *pga.SivaRepository
+	if b.cursor < len(b.visible) {
+		current = b.visible[b.cursor]
+	}
+	b.visible = b.visible[:0]
+	for _, r := range b.repos {
+		if b.matches(r) {
+			b.visible = append(b.visible, r)
+		}
+	}
+	if b.sortColumn >= 0 {
+		less := browseColumns[b.sortColumn].less
+		sort.SliceStable(b.visible, func(i, j int) bool {
+			if b.desc {
+				return less(b.visible[j], b.visible[i])
+			}
+			return less(b.visible[i], b.visible[j])
+		})
+	} else if b.desc {
+		for i, j := 0, len(b.visible)-1; i < j; i, j = i+1, j-1 {
+			b.visible[i], b.visible[j] = b.visible[j], b.visible[i]
+		}
+	}
+	b.cursor = 0
+	for i, r := range b.visible {
+		if r == current {
+			b.cursor = i
+			break
+		}
+	}
+}
+
+func (b *browser) move(delta int) {
+	b.cursor += delta
+	if b.cursor >= len(b.visible) {
+		b.cursor = len(b.visible) - 1
+	}
+	if b.cursor < 0 {
+		b.cursor = 0
+	}
+}
+
+// nextSortColumn cycles through the sortable columns and the index order.
+func (b *browser) nextSortColumn() {
+	for {
+		b.sortColumn++
+		if b.sortColumn >= len(browseColumns) {
+			b.sortColumn = -1
+			return
+		}
+		if browseColumns[b.sortColumn].less != nil {
+			return
+		}
+	}
+}
+
+func (b *browser) handleKey(key string) {
+	b.status = ""
+	if key == keyCtrlC {
+		b.done = true
+		return
+	}
+	if b.editing >= 0 {
+		input := &b.inputs[b.editing]
+		switch key {
+		case keyEnter, keyEscape:
+			b.editing = -1
+		case keyBackspace:
+			if len(*input) > 0 {
+				_, n := utf8.DecodeLastRuneInString(*input)
+				*input = (*input)[:len(*input)-n]
+			}
+		case keyUp, keyDown, keyPageUp, keyPageDown, keyHome, keyEnd:
+			b.editing = -1
+			b.handleKey(key)
+			return
+		default:
+			if utf8.RuneCountInString(key) != 1 {
+				return
+			}
+			if b.editing == inputStars && (key < "0" || key > "9") {
+				return
+			}
+			*input += key
+		}
+		b.refresh()
+		return
+	}
+
+	if input, ok := inputKeys[key]; ok {
+		b.editing = input
+		return
+	}
+	switch key {
+	case "q":
+		b.done = true
+	case keyUp, "k":
+		b.move(-1)
+	case keyDown, "j":
+		b.move(1)
+	case keyPageUp:
+		b.move(-b.pageSize)
+	case keyPageDown:
+		b.move(b.pageSize)
+	case keyHome, "g":
+		b.move(-len(b.visible))
+	case keyEnd, "G":
+		b.move(len(b.visible))
+	case " ":
+		if b.cursor < len(b.visible) {
+			r := b.visible[b.cursor]
+			if b.marked[r] {
+				delete(b.marked, r)
+			} else {
+				b.marked[r] = true
+			}
+			b.move(1)
+		}
+	case "a":
+		all := true
+		for _, r := range b.visible {
+			all = all && b.marked[r]
+		}
+		for _, r := range b.visible {
+			if all {
+				delete(b.marked, r)
+			} else {
+				b.marked[r] = true
+			}
+		}
+	case "x":
+		b.inputs = [numInputs]string{}
+		b.refresh()
+	case "o":
+		b.nextSortColumn()
+		b.refresh()
+	case "r":
+		b.desc = !b.desc
+		b.refresh()
+	case "d":
+		if len(b.marked) == 0 {
+			b.status = "no repositories marked, mark them with space"
+			return
+		}
+		b.done = true
+		b.download = true
+	}
+}
+
+// markedSize returns the total size of the marked repositories, as far as
+// the index knows.
+func (b *browser) markedSize() int64 {
+	var size int64
+	for r := range b.marked {
+		if r.Size > 0 {
+			size += r.Size
+		}
+	}
+	return size
+}
+
+// fit truncates or pads s to exactly width characters.
+func fit(s string, width int, right bool) string {
+	if width <= 0 {
+		return ""
+	}
+	n := utf8.RuneCountInString(s)
+	if n > width {
+		runes := []rune(s)
+		if width == 1 {
+			return string(runes[:1])
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	pad := strings.Repeat(" ", width-n)
+	if right {
+		return pad + s
+	}
+	return s + pad
+}
+
+func (b *browser) row(r *pga.SivaRepository, width int, header bool) string {
+	urlWidth := width - 2
+	for _, c := range browseColumns[1:] {
+		urlWidth -= c.width + 1
+	}
+	var parts []string
+	for i, c := range browseColumns {
+		w := c.width
+		if i == 0 {
+			w = urlWidth
+		}
+		var value string
+		if header {
+			value = c.name
+			if i == b.sortColumn && b.desc {
+				value += "↓"
+			} else if i == b.sortColumn {
+				value += "↑"
+			}
+		} else {
+			value = c.value(r)
+		}
+		parts = append(parts, fit(value, w, c.right))
+	}
+	mark := "  "
+	if !header && b.marked[r] {
+		mark = "* "
+	}
+	return fit(mark+strings.Join(parts, " "), width, false)
+}
+
+func (b *browser) filterLine() string {
+	var parts []string
+	for i, label := range inputLabels {
+		value := b.inputs[i]
+		if i == b.editing {
+			value += "_"
+		} else if value == "" {
+			continue
+		}
+		parts = append(parts, label+": "+value)
+	}
+	sortName := "index"
+	if b.sortColumn >= 0 {
+		sortName = strings.ToLower(browseColumns[b.sortColumn].name)
+	}
+	if b.desc {
+		sortName += " desc"
+	}
+	parts = append(parts, "sort: "+sortName)
+	return strings.Join(parts, "  ")
+}
+
+// details describes the repository under the cursor.
+func (b *browser) details() []string {
+	if b.cursor >= len(b.visible) {
+		return nil
+	}
+	r := b.visible[b.cursor]
+	lines := []string{
+		r.URL,
+		fmt.Sprintf("license: %s  stars: %s  forks: %s  commits: %s  branches: %s",
+			r.License, formatCount(r.Stars), formatCount(r.Forks), formatCount(r.Commits), formatCount(r.Branches)),
+		fmt.Sprintf("files: %s  siva files: %s", formatCount(r.Files), strings.Join(r.SivaFilenames, ", ")),
+	}
+	at := func(values []int64, i int) int64 {
+		if i < len(values) {
+			return values[i]
+		}
+		return -1
+	}
+	for i, lang := range r.Languages {
+		lines = append(lines, fmt.Sprintf("%s: %s files, %s bytes, %s lines (%s code, %s comments, %s blank)",
+			lang, formatCount(at(r.LanguagesFileCount, i)), formatCount(at(r.LanguagesByteCount, i)),
+			formatCount(at(r.LanguagesLineCount, i)), formatCount(at(r.LanguagesCodeLines, i)),
+			formatCount(at(r.LanguagesCommentLines, i)), formatCount(at(r.LanguagesEmptyLines, i))))
+	}
+	return lines
+}
+
+// render returns the escape sequences drawing the whole screen.
+func (b *browser) render(width, height int) string {
+	lines := []string{
+		fmt.Sprintf("%s: %d of %d repositories, %d marked (%s)", b.title, len(b.visible), len(b.repos),
+			len(b.marked), humanize.Bytes(uint64(b.markedSize()))),
+		b.filterLine(),
+		"\x1b[1m" + b.row(nil, width, true) + "\x1b[0m",
+	}
+	details := detailHeight
+	if height < 3+detailHeight+1+1+5 {
+		details = 0
+	}
+	b.pageSize = height - len(lines) - 1
+	if details > 0 {
+		b.pageSize -= details + 1
+	}
+	if b.pageSize < 1 {
+		b.pageSize = 1
+	}
+	if b.cursor < b.top {
+		b.top = b.cursor
+	} else if b.cursor >= b.top+b.pageSize {
+		b.top = b.cursor - b.pageSize + 1
+	}
+	for i := b.top; i < b.top+b.pageSize; i++ {
+		switch {
+		case i >= len(b.visible):
+			lines = append(lines, "")
+		case i == b.cursor:
+			lines = append(lines, "\x1b[7m"+b.row(b.visible[i], width, false)+"\x1b[0m")
+		default:
+			lines = append(lines, b.row(b.visible[i], width, false))
+		}
+	}
+	if details > 0 {
+		lines = append(lines, strings.Repeat("─", width))
+		d := b.details()
+		for i := 0; i < details; i++ {
+			if i < len(d) {
+				lines = append(lines, d[i])
+			} else {
+				lines = append(lines, "")
+			}
+		}
+	}
+	footer := browseHelp
+	if b.status != "" {
+		footer = b.status
+	}
+	lines = append(lines, footer)
+
+	var buf bytes.Buffer
+	buf.WriteString("\x1b[H")
+	for i, line := range lines {
+		if i > 0 {
+			buf.WriteString("\r\n")
+		}
+		if !strings.HasPrefix(line, "\x1b") {
+			line = fit(line, width, false)
+		}
+		buf.WriteString(line)
+		buf.WriteString("\x1b[K")
+	}
+	return buf.String()
+}
+
+// run shows the browser in the terminal until the user quits.
+func (b *browser) run() error {
+	in, out := int(os.Stdin.Fd()), int(os.Stdout.Fd())
+	if !terminal.IsTerminal(in) || !terminal.IsTerminal(out) {
+		return fmt.Errorf("pga browse must be run in a terminal, use pga list otherwise")
+	}
+	state, err := terminal.MakeRaw(in)
+	if err != nil {
+		return err
+	}
+	defer terminal.Restore(in, state)
+	// Use the alternate screen and hide the cursor while browsing.
+	fmt.Print("\x1b[?1049h\x1b[?25l\x1b[2J")
+	defer fmt.Print("\x1b[?25h\x1b[?1049l")
+
+	// The input is read in the background to tell the escape key from the
+	// beginning of a longer escape sequence split across reads.
+	type input struct {
+		b   []byte
+		err error
+	}
+	inputs := make(chan input)
+	go func() {
+		for {
+			buf := make([]byte, 64)
+			n, err := os.Stdin.Read(buf)
+			inputs <- input{buf[:n], err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	for !b.done {
+		width, height, err := terminal.GetSize(out)
+		if err != nil {
+			width, height = 80, 24
+		}
+		if _, err := os.Stdout.WriteString(b.render(width, height)); err != nil {
+			return err
+		}
+		var (
+			keys    []string
+			timeout <-chan time.Time
+		)
+		if len(pending) > 0 {
+			timeout = time.After(escapeTimeout)
+		}
+		select {
+		case in := <-inputs:
+			if in.err != nil {
+				return in.err
+			}
+			keys, pending = parseKeys(append(pending, in.b...), false)
+		case <-timeout:
+			keys, pending = parseKeys(pending, true)
+		}
+		for _, key := range keys {
+			b.handleKey(key)
+		}
+	}
+	return nil
+}
+
+// browseCmd represents the browse command
+var browseCmd = &cobra.Command{
+	Use:   "browse",
+	Short: "explore the repositories in the index interactively",
+	Long: `Explore the repositories of the siva index in the terminal, use flags to
+filter the repositories loaded.
+
+Search the URLs with /, filter by language with l, by minimum stars with s and
+by license with L, all updated as you type, and sort the columns with o and r.
+Mark repositories with space and press d to download their siva files to the
+output location, as pga get would.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		dataset, err := handleDatasetArg(cmd.Use, flags)
+		if err != nil {
+			return err
+		}
+		if _, ok := dataset.(*pga.SivaDataset); !ok {
+			return fmt.Errorf("pga browse only supports the siva dataset")
+		}
+		dest, err := FileSystemFromFlags(flags)
+		if err != nil {
+			return err
+		}
+		maxDownloads, err := flags.GetInt("jobs")
+		if err != nil {
+			return err
+		}
+		rate, err := flags.GetString("rate-limit")
+		if err != nil {
+			return err
+		}
+		bytesPerSecond, err := parseRate(rate)
+		if err != nil {
+			return fmt.Errorf("invalid --rate-limit: %v", err)
+		}
+		retries, err := flags.GetInt("retries")
+		if err != nil {
+			return err
+		}
+		store, err := storeFromFlags(flags, dest)
+		if err != nil {
+			return err
+		}
+		filter, err := filterFromFlags(flags)
+		if err != nil {
+			return err
+		}
+
+		ctx := setupContext()
+		resolveVersion(ctx, dataset.Name())
+		f, err := getIndex(ctx, dataset.Name())
+		if err != nil {
+			return fmt.Errorf("could not open index file: %v", err)
+		}
+		var repos []*pga.SivaRepository
+		err = pga.ForEachRepository(ctx, csv.NewReader(f), dataset, filter, func(r pga.Repository) error {
+			repos = append(repos, r.(*pga.SivaRepository))
+			return nil
+		})
+		f.Close()
+		if err != nil {
+			return err
+		}
+
+		b := newBrowser(fmt.Sprintf("pga %s %s", dataset.Name(), pgaVersion), repos)
+		if err := b.run(); err != nil || !b.download {
+			return err
+		}
+
+		filenames := map[string]struct{}{}
+		for r := range b.marked {
+			for _, filename := range r.GetFilenames() {
+				filenames[filename] = struct{}{}
+			}
+		}
+		fmt.Fprintf(os.Stderr, "downloading %d files of %d repositories to %s\n",
+			len(filenames), len(b.marked), dest.Abs(""))
+		return downloadFilenames(ctx, dest, urlFS(mirrorURL), dataset.Name(), filenames,
+			newConcurrencyLimiter(maxDownloads), newRateLimiter(bytesPerSecond), retries, store)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(browseCmd)
+	flags := browseCmd.Flags()
+	addFilterFlags(flags)
+	flags.StringP("output", "o", ".", "path where the siva files of the marked repositories should be stored")
+	flags.IntP("jobs", "j", 10, "number of concurrent gets allowed")
+	flags.String("rate-limit", "", "maximum total download rate shared by all jobs, e.g. 200MB/s")
+	flags.Int("retries", 0, "number of times a failed download is retried")
+	flags.String("store", "", "directory of a content-addressed store shared by the versions the files are linked to")
+}
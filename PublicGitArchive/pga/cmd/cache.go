@@ -4,30 +4,50 @@ import (
 	"compress/gzip"
 	"context"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
 	"net/url"
+	"os"
 	"os/user"
 	"path"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
 )
 
-const indexURL = "http://pga.sourced.tech/csv"
-
 // updateCache checks whether a new version of the file in url exists and downloads it
 // to dest. It returns an error when it was not possible to update it.
-func updateCache(ctx context.Context, dest, source FileSystem, name string) error {
+// The copy is throttled by bw, which can be nil.
+func updateCache(ctx context.Context, dest, source FileSystem, name string, bw *rateLimiter) error {
 	logrus.Debugf("syncing %s to %s", source.Abs(name), dest.Abs(name))
 	if upToDate(dest, source, name) {
 		logrus.Debugf("local copy is up to date")
+		events.emit(event{Event: eventSkip, File: name})
 		return nil
 	}
-
 	logrus.Debugf("local copy is outdated or non existent")
+	return fetch(ctx, dest, source, name, bw, nil)
+}
+
+// fetch downloads name from source to dest through a temporary file. The
+// contents are also written to h if it is not nil, e.g. to hash them.
+func fetch(ctx context.Context, dest, source FileSystem, name string, bw *rateLimiter, h hash.Hash) (err error) {
+	events.emit(event{Event: eventStart, File: name})
+	start := time.Now()
+	defer func() {
+		e := event{File: name}
+		if err == nil {
+			e.Bytes, _ = dest.Size(name)
+		}
+		events.finish(e, start, err)
+	}()
+
 	tmpName := name + ".tmp"
-	if err := copy(ctx, source, dest, name, tmpName); err != nil {
+	if err := copy(ctx, source, dest, name, tmpName, bw, h); err != nil {
 		if cerr := dest.Remove(tmpName); cerr != nil {
 			logrus.Warningf("error removing temporary file %s: %v",
 				dest.Abs(tmpName), cerr)
@@ -48,7 +68,7 @@ func updateCache(ctx context.Context, dest, source FileSystem, name string) erro
 }
 
 func copy(ctx context.Context, source, dest FileSystem,
-	sourceName, destName string) (err error) {
+	sourceName, destName string, bw *rateLimiter, h hash.Hash) (err error) {
 
 	wc, err := dest.Create(destName)
 	if err != nil {
@@ -61,7 +81,11 @@ func copy(ctx context.Context, source, dest FileSystem,
 		return err
 	}
 
-	if err = cancelableCopy(ctx, wc, rc); err != nil {
+	w := events.writer(wc, sourceName)
+	if h != nil {
+		w = io.MultiWriter(w, h)
+	}
+	if err = cancelableCopy(ctx, w, rc, bw); err != nil {
 		_ = rc.Close()
 		_ = wc.Close()
 		if _, cancel := err.(*pga.CommandCanceledError); !cancel {
@@ -80,7 +104,7 @@ func copy(ctx context.Context, source, dest FileSystem,
 
 const copyBufferSize = 512 * 1024
 
-func cancelableCopy(ctx context.Context, dst io.Writer, src io.Reader) error {
+func cancelableCopy(ctx context.Context, dst io.Writer, src io.Reader, bw *rateLimiter) error {
 	var written int64
 	for {
 		select {
@@ -91,6 +115,9 @@ func cancelableCopy(ctx context.Context, dst io.Writer, src io.Reader) error {
 
 		w, err := io.CopyN(dst, src, copyBufferSize)
 		written += w
+		if werr := bw.wait(ctx, w); werr != nil {
+			return werr
+		}
 		if err == io.EOF {
 			return nil
 		}
@@ -132,24 +159,116 @@ func matchHash(dest, source FileSystem, name string) bool {
 	return localHash == remoteHash
 }
 
-func getIndex(ctx context.Context, datasetName string) (io.ReadCloser, error) {
+// cacheDirEnv is the environment variable overriding the default cache directory.
+const cacheDirEnv = "PGA_CACHE_DIR"
+
+// cacheDir returns the directory where the indexes are cached, $PGA_CACHE_DIR
+// if set, the cache of the configuration or ~/.pga otherwise.
+func cacheDir() (string, error) {
+	if dir := os.Getenv(cacheDirEnv); dir != "" {
+		return dir, nil
+	}
 	usr, err := user.Current()
 	if err != nil {
-		return nil, err
+		return "", err
 	}
-	dest := localFS(filepath.Join(usr.HomeDir, ".pga", datasetName))
-	u, err := url.Parse(indexURL)
+	if pgaConfig != nil && pgaConfig.Cache != "" {
+		dir := pgaConfig.Cache
+		if dir == "~" || strings.HasPrefix(dir, "~/") {
+			dir = filepath.Join(usr.HomeDir, dir[1:])
+		}
+		return dir, nil
+	}
+	return filepath.Join(usr.HomeDir, ".pga"), nil
+}
+
+// indexCache returns the file system holding the cached indexes of a dataset.
+func indexCache(datasetName string) (localFS, error) {
+	dir, err := cacheDir()
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	return localFS(filepath.Join(dir, datasetName)), nil
+}
+
+// indexSource returns the file system serving the indexes of a dataset.
+func indexSource(datasetName string) (urlFS, error) {
+	u, err := url.Parse(mirrorURL)
+	if err != nil {
+		return "", err
+	}
+	u.Path = path.Join(u.Path, "csv", datasetName)
+	return urlFS(u.String()), nil
+}
+
+const checkedSuffix = ".checked"
+
+// checkInterval is how long a cached file checked against the server is
+// trusted without checking it again.
+const checkInterval = time.Hour
+
+// refreshIndex syncs the cached copy of the index of the version in use with
+// the server and records when it was last checked.
+func refreshIndex(ctx context.Context, datasetName string) (localFS, error) {
+	return refreshIndexFile(ctx, datasetName, indexName)
+}
+
+// refreshIndexFile syncs the cached copy of the index name of a dataset with
+// the server and records when it was last checked.
+func refreshIndexFile(ctx context.Context, datasetName, name string) (localFS, error) {
+	dest, err := indexCache(datasetName)
+	if err != nil {
+		return "", err
+	}
+	source, err := indexSource(datasetName)
+	if err != nil {
+		return "", err
+	}
+
+	if err := updateCache(ctx, dest, source, name, nil); err != nil {
+		return "", err
+	}
+
+	markChecked(dest, name)
+	return dest, nil
+}
+
+// markChecked records that the cached file name was just checked against the
+// server.
+func markChecked(dest localFS, name string) {
+	checked := []byte(time.Now().UTC().Format(time.RFC3339))
+	// The file may not have been downloaded, e.g. if it is missing in the server.
+	err := os.MkdirAll(filepath.Dir(dest.Abs(name)), os.ModePerm)
+	if err == nil {
+		err = ioutil.WriteFile(dest.Abs(name+checkedSuffix), checked, 0644)
+	}
+	if err != nil {
+		logrus.Warnf("could not record the last check of %s: %v", dest.Abs(name), err)
+	}
+}
+
+// lastChecked returns when the cached index name was last checked against the server.
+func lastChecked(dest localFS, name string) (time.Time, error) {
+	b, err := ioutil.ReadFile(dest.Abs(name + checkedSuffix))
+	if err != nil {
+		return time.Time{}, err
 	}
-	u.Path = path.Join(u.Path, datasetName)
-	source := urlFS(u.String())
+	return time.Parse(time.RFC3339, strings.TrimSpace(string(b)))
+}
+
+// getIndex returns the uncompressed index of the version in use.
+func getIndex(ctx context.Context, datasetName string) (io.ReadCloser, error) {
+	return openIndex(ctx, datasetName, indexName)
+}
 
-	if err := updateCache(ctx, dest, source, indexName); err != nil {
+// openIndex returns the uncompressed index name of a dataset, refreshed first.
+func openIndex(ctx context.Context, datasetName, name string) (io.ReadCloser, error) {
+	dest, err := refreshIndexFile(ctx, datasetName, name)
+	if err != nil {
 		return nil, err
 	}
 
-	f, err := dest.Open(indexName)
+	f, err := dest.Open(name)
 	if err != nil {
 		return nil, err
 	}
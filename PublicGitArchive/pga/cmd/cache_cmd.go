@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+)
+
+const indexSuffix = ".index.csv.gz"
+
+var cacheActions = map[string]func(flags *pflag.FlagSet, datasets []pga.Dataset) error{
+	"list":    cacheList,
+	"clean":   cacheClean,
+	"prune":   cachePrune,
+	"refresh": cacheRefresh,
+}
+
+// cachedIndex is a copy of an index stored in the cache directory.
+type cachedIndex struct {
+	dataset string
+	version string
+	dir     localFS
+}
+
+func (c cachedIndex) name() string { return c.version + indexSuffix }
+
+// cachedIndexes returns the cached copies of the indexes of the given datasets.
+func cachedIndexes(datasets []pga.Dataset) ([]cachedIndex, error) {
+	var indexes []cachedIndex
+	for _, dataset := range datasets {
+		dir, err := indexCache(dataset.Name())
+		if err != nil {
+			return nil, err
+		}
+		infos, err := ioutil.ReadDir(string(dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() || !strings.HasSuffix(name, indexSuffix) {
+				continue
+			}
+			indexes = append(indexes, cachedIndex{
+				dataset: dataset.Name(),
+				version: strings.TrimSuffix(name, indexSuffix),
+				dir:     dir,
+			})
+		}
+	}
+	return indexes, nil
+}
+
+func cacheList(flags *pflag.FlagSet, datasets []pga.Dataset) error {
+	indexes, err := cachedIndexes(datasets)
+	if err != nil {
+		return err
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "DATASET\tVERSION\tSIZE\tMD5\tLAST CHECKED")
+	for _, index := range indexes {
+		size, err := index.dir.Size(index.name())
+		if err != nil {
+			return err
+		}
+		hash, err := index.dir.MD5(index.name())
+		if err != nil {
+			return err
+		}
+		checked := "never"
+		if t, err := lastChecked(index.dir, index.name()); err == nil {
+			checked = t.Local().Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", index.dataset, index.version,
+			humanize.Bytes(uint64(size)), hash, checked)
+	}
+	return w.Flush()
+}
+
+func removeCachedIndex(index cachedIndex) error {
+	for _, name := range []string{index.name(), index.name() + checkedSuffix, index.name() + ".tmp"} {
+		if err := index.dir.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	fmt.Printf("removed %s version %s\n", index.dataset, index.version)
+	return nil
+}
+
+func cacheClean(flags *pflag.FlagSet, datasets []pga.Dataset) error {
+	indexes, err := cachedIndexes(datasets)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if err := removeCachedIndex(index); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cachePrune removes every cached index but the one for the version in use,
+// as well as the leftovers of interrupted downloads.
+func cachePrune(flags *pflag.FlagSet, datasets []pga.Dataset) error {
+	ctx := setupContext()
+	keep := map[string]string{}
+	for _, dataset := range datasets {
+		resolveVersion(ctx, dataset.Name())
+		keep[dataset.Name()] = pgaVersion
+	}
+	indexes, err := cachedIndexes(datasets)
+	if err != nil {
+		return err
+	}
+	for _, index := range indexes {
+		if index.version == keep[index.dataset] {
+			continue
+		}
+		if err := removeCachedIndex(index); err != nil {
+			return err
+		}
+	}
+	for _, dataset := range datasets {
+		dir, err := indexCache(dataset.Name())
+		if err != nil {
+			return err
+		}
+		tmps, err := filepath.Glob(dir.Abs("*.tmp"))
+		if err != nil {
+			return err
+		}
+		for _, tmp := range tmps {
+			if err := os.Remove(tmp); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func cacheRefresh(flags *pflag.FlagSet, datasets []pga.Dataset) error {
+	ctx := setupContext()
+	for _, dataset := range datasets {
+		if _, err := getCatalog(ctx, dataset.Name(), 0); err != nil {
+			logrus.Warnf("could not refresh the %s version catalog: %v", dataset.Name(), err)
+		}
+		resolveVersion(ctx, dataset.Name())
+		if _, err := refreshIndex(ctx, dataset.Name()); err != nil {
+			return fmt.Errorf("could not refresh the %s index: %v", dataset.Name(), err)
+		}
+		fmt.Printf("refreshed %s version %s\n", dataset.Name(), pgaVersion)
+	}
+	return nil
+}
+
+// cacheCmd represents the set of commands to manage the cached indexes.
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "manage the locally cached indexes",
+	Long: `List, clean, prune or refresh the indexes cached in ~/.pga, in $PGA_CACHE_DIR if
+set, or in the cache directory of the configuration.
+
+The action applies to all the datasets unless one is given.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		if flags.NArg() < 1 || flags.NArg() > 2 {
+			return fmt.Errorf("usage: pga cache <action> [dataset]")
+		}
+		action := flags.Arg(0)
+		actionFunc, exists := cacheActions[action]
+		if !exists {
+			knownActions := make([]string, 0, len(cacheActions))
+			for k := range cacheActions {
+				knownActions = append(knownActions, k)
+			}
+			sort.Strings(knownActions)
+			return fmt.Errorf("unknown action: %s (choose from %s)",
+				action, strings.Join(knownActions, ", "))
+		}
+		datasets := pga.Datasets
+		if flags.NArg() == 2 {
+			dataset, err := datasetByName(flags.Arg(1))
+			if err != nil {
+				return err
+			}
+			datasets = []pga.Dataset{dataset}
+		}
+		return actionFunc(flags, datasets)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(cacheCmd)
+}
@@ -0,0 +1,280 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// projectConfigName is the name of the project-local configuration file.
+const projectConfigName = ".pga.yaml"
+
+// userConfigName is the name of the user configuration file, in ~/.pga.
+const userConfigName = "config.yaml"
+
+// projectConfig holds the settings shared by everyone working on a project,
+// or by all the projects of a user.
+type projectConfig struct {
+	// Pin maps dataset names to the version that should be used by default.
+	Pin map[string]string `yaml:"pin,omitempty"`
+	// Cache is the directory where the indexes are cached.
+	Cache string `yaml:"cache,omitempty"`
+	// Profile is the profile used unless --profile is given.
+	Profile string `yaml:"profile,omitempty"`
+	// Defaults maps flag names to the value used by every command with that
+	// flag unless it is given explicitly.
+	Defaults map[string]interface{} `yaml:"defaults,omitempty"`
+	// Profiles are named sets of flag values, selected with --profile.
+	Profiles map[string]map[string]interface{} `yaml:"profiles,omitempty"`
+	// Filters are named sets of filter flag values, selected with --filter.
+	Filters map[string]map[string]interface{} `yaml:"filters,omitempty"`
+}
+
+// findProjectConfig returns the path of the closest .pga.yaml in the current
+// directory or any of its parents, or an empty string if there is none.
+func findProjectConfig() (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	for {
+		path := filepath.Join(dir, projectConfigName)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return "", nil
+		}
+		dir = parent
+	}
+}
+
+// loadProjectConfig reads the closest project-local configuration file and
+// returns it together with its path. If there is none, an empty config and
+// the path where it would be created are returned.
+func loadProjectConfig() (*projectConfig, string, error) {
+	path, err := findProjectConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	if path == "" {
+		return &projectConfig{}, projectConfigName, nil
+	}
+	config, err := readConfig(path)
+	if err != nil {
+		return nil, "", err
+	}
+	return config, path, nil
+}
+
+func readConfig(path string) (*projectConfig, error) {
+	config := &projectConfig{}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := yaml.Unmarshal(b, config); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %v", path, err)
+	}
+	return config, nil
+}
+
+// loadConfig returns the user configuration in ~/.pga/config.yaml merged with
+// the project configuration, whose settings take precedence.
+func loadConfig() (*projectConfig, error) {
+	config := &projectConfig{}
+	usr, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	userPath := filepath.Join(usr.HomeDir, ".pga", userConfigName)
+	if userConfig, err := readConfig(userPath); err == nil {
+		config.merge(userConfig)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	projectConfig, _, err := loadProjectConfig()
+	if err != nil {
+		return nil, err
+	}
+	config.merge(projectConfig)
+	return config, nil
+}
+
+// merge overrides the settings of c with those in other.
+func (c *projectConfig) merge(other *projectConfig) {
+	if other.Cache != "" {
+		c.Cache = other.Cache
+	}
+	if other.Profile != "" {
+		c.Profile = other.Profile
+	}
+	if c.Pin == nil {
+		c.Pin = map[string]string{}
+	}
+	for k, v := range other.Pin {
+		c.Pin[k] = v
+	}
+	c.Defaults = mergeSettings(c.Defaults, other.Defaults)
+	c.Profiles = mergeNamedSettings(c.Profiles, other.Profiles)
+	c.Filters = mergeNamedSettings(c.Filters, other.Filters)
+}
+
+func mergeSettings(dst, src map[string]interface{}) map[string]interface{} {
+	if dst == nil {
+		dst = map[string]interface{}{}
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+func mergeNamedSettings(dst, src map[string]map[string]interface{}) map[string]map[string]interface{} {
+	if dst == nil {
+		dst = map[string]map[string]interface{}{}
+	}
+	for name, settings := range src {
+		dst[name] = mergeSettings(dst[name], settings)
+	}
+	return dst
+}
+
+// settingValue returns the value of a setting as it would be given in the
+// command line, lists are joined with commas.
+func settingValue(v interface{}) string {
+	if list, ok := v.([]interface{}); ok {
+		values := make([]string, len(list))
+		for i, item := range list {
+			values[i] = fmt.Sprint(item)
+		}
+		return strings.Join(values, ",")
+	}
+	return fmt.Sprint(v)
+}
+
+// knownFlag returns whether any command has a flag with the given name.
+func knownFlag(cmd *cobra.Command, name string) bool {
+	if cmd.Flags().Lookup(name) != nil || cmd.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+	for _, c := range cmd.Commands() {
+		if knownFlag(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterCommands are the commands selecting repositories of the index with
+// the filter flags.
+var filterCommands = []string{"list", "get", "du", "mirror", "browse"}
+
+// configCommands are the commands the settings of the flags declared with
+// different meanings by several commands apply to. The settings of the other
+// flags apply to every command declaring them.
+var configCommands = map[string][]string{
+	"output": {"get", "du", "browse"},
+	"jobs":   {"get", "mirror", "browse"},
+	"format": {"list"},
+}
+
+// configApplies returns whether the setting of a flag applies to cmd.
+func configApplies(cmd *cobra.Command, name string) bool {
+	commands, ok := configCommands[name]
+	if name == "filter" || isFilterFlag(name) {
+		commands, ok = filterCommands, true
+	}
+	if !ok {
+		return true
+	}
+	for _, c := range commands {
+		if c == cmd.Name() {
+			return true
+		}
+	}
+	return false
+}
+
+// isSet returns whether a flag was given explicitly or set by the
+// configuration.
+func isSet(f *pflag.Flag) bool {
+	return f.Changed || f.Value.String() != f.DefValue
+}
+
+// apply sets the flags of cmd which were not given explicitly from the
+// defaults, then the profile and then the named filter of the configuration.
+// Only the settings of the flags with the same meaning in cmd as in the other
+// commands are applied, but the whole named filter given with --filter is.
+// The flags set stay unchanged, as they were not given explicitly.
+func (c *projectConfig) apply(cmd *cobra.Command) error {
+	flags := cmd.Flags()
+	profile, err := flags.GetString("profile")
+	if err != nil {
+		return err
+	}
+	if profile == "" {
+		profile = c.Profile
+	}
+	settings := mergeSettings(nil, c.Defaults)
+	if profile != "" {
+		p, ok := c.Profiles[profile]
+		if !ok {
+			return fmt.Errorf("unknown profile %q in the configuration", profile)
+		}
+		settings = mergeSettings(settings, p)
+	}
+
+	var filter string
+	explicitFilter := false
+	if f := flags.Lookup("filter"); f != nil && f.Changed {
+		filter, explicitFilter = f.Value.String(), true
+	} else if v, ok := settings["filter"]; ok && f != nil && configApplies(cmd, "filter") {
+		filter = settingValue(v)
+	}
+	if filter != "" {
+		f, ok := c.Filters[filter]
+		if !ok {
+			return fmt.Errorf("unknown filter %q in the configuration", filter)
+		}
+		for name, v := range f {
+			if !isFilterFlag(name) {
+				return fmt.Errorf("%s is not a filter flag in the filter %q", name, filter)
+			}
+			settings[name] = v
+		}
+	}
+
+	for name, v := range settings {
+		if !knownFlag(cmd.Root(), name) {
+			return fmt.Errorf("unknown setting %q in the configuration", name)
+		}
+		f := flags.Lookup(name)
+		if f == nil || f.Changed || name == "filter" {
+			continue
+		}
+		if !configApplies(cmd, name) && !(explicitFilter && isFilterFlag(name)) {
+			continue
+		}
+		if err := f.Value.Set(settingValue(v)); err != nil {
+			return fmt.Errorf("invalid setting %s in the configuration: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *projectConfig) save(path string) error {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
@@ -11,7 +11,7 @@ import (
 
 func setupContext() context.Context {
 	ctx, cancel := context.WithCancel(context.Background())
-	var term = make(chan os.Signal)
+	var term = make(chan os.Signal, 1)
 	go func() {
 		select {
 		case <-term:
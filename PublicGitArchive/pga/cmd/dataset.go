@@ -13,7 +13,17 @@ func handleDatasetArg(cmd string, flags *pflag.FlagSet) (pga.Dataset, error) {
 	if flags.NArg() != 1 {
 		return nil, fmt.Errorf("usage: pga list <dataset>")
 	}
-	datasetName := flags.Arg(0)
+	dataset, err := datasetByName(flags.Arg(0))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkDatasetFilterFlags(flags, dataset); err != nil {
+		return nil, err
+	}
+	return dataset, nil
+}
+
+func datasetByName(datasetName string) (pga.Dataset, error) {
 	for _, dataset := range pga.Datasets {
 		if datasetName == dataset.Name() {
 			return dataset, nil
@@ -0,0 +1,266 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+)
+
+// fileLister is implemented by the file systems able to list their files.
+type fileLister interface {
+	Walk(dir string, f func(path string, size int64) error) error
+}
+
+// languageDiskUsage summarizes the files of the repositories of a language.
+type languageDiskUsage struct {
+	Repositories int
+	Present      int
+	PresentBytes int64
+	Missing      int
+	MissingBytes int64
+}
+
+// diskUsage compares the files in a destination with an index.
+type diskUsage struct {
+	Languages    map[string]*languageDiskUsage
+	Files        int
+	Present      int
+	PresentBytes int64
+	Mismatched   int // present files whose size differs from the index.
+	Missing      int
+	MissingBytes int64
+	Orphans      []string
+	OrphanBytes  int64
+}
+
+// noLanguage is the language of the repositories without any.
+const noLanguage = "(none)"
+
+// computeDiskUsage compares the files of the version of the dataset in dest
+// with the index. Only the repositories selected by filter are reported, but
+// files are orphans only if no repository references them in the version.
+// The files of the other versions are only orphans if otherVersions is set.
+// Interrupted downloads are never orphans, they may be in progress.
+func computeDiskUsage(ctx context.Context, dest FileSystem, dataset pga.Dataset, index *csv.Reader,
+	filter pga.Filter, otherVersions bool) (*diskUsage, error) {
+
+	lister, ok := dest.(fileLister)
+	if !ok {
+		return nil, fmt.Errorf("can not list the files in %s", dest.Abs(""))
+	}
+	dir := filepath.Join(dataset.Name(), pgaVersion)
+	if otherVersions {
+		dir = dataset.Name()
+	}
+	sizes := map[string]int64{}
+	err := lister.Walk(dir, func(p string, size int64) error {
+		if !strings.HasSuffix(p, ".tmp") {
+			sizes[p] = size
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not list the files in %s: %v", dest.Abs(dir), err)
+	}
+
+	du := &diskUsage{Languages: map[string]*languageDiskUsage{}}
+	referenced := map[string]bool{}
+	counted := map[string]bool{}
+	err = pga.ForEachRepository(ctx, index, dataset, func(pga.Repository) bool { return true },
+		func(r pga.Repository) error {
+			names := r.GetFilenames()
+			for _, filename := range names {
+				referenced[filepath.ToSlash(datasetPath(dataset.Name(), filename))] = true
+			}
+			if !filter(r) {
+				return nil
+			}
+			langs := r.GetLanguages()
+			if len(langs) == 0 {
+				langs = []string{noLanguage}
+			}
+			for _, lang := range langs {
+				if du.Languages[lang] == nil {
+					du.Languages[lang] = &languageDiskUsage{}
+				}
+				du.Languages[lang].Repositories++
+			}
+			for _, filename := range names {
+				p := filepath.ToSlash(datasetPath(dataset.Name(), filename))
+				// The index only knows the size of a file when it holds a
+				// single repository.
+				expected := int64(-1)
+				if len(names) == 1 {
+					expected = r.GetSize()
+				}
+				size, present := sizes[p]
+				for _, lang := range langs {
+					u := du.Languages[lang]
+					if present {
+						u.Present++
+						u.PresentBytes += size
+					} else {
+						u.Missing++
+						if expected > 0 {
+							u.MissingBytes += expected
+						}
+					}
+				}
+				if counted[p] {
+					continue
+				}
+				counted[p] = true
+				du.Files++
+				if !present {
+					du.Missing++
+					if expected > 0 {
+						du.MissingBytes += expected
+					}
+					continue
+				}
+				du.Present++
+				du.PresentBytes += size
+				if expected >= 0 && expected != size {
+					du.Mismatched++
+				}
+			}
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	for p, size := range sizes {
+		// Checksums belong to their file.
+		if !referenced[strings.TrimSuffix(p, md5Suffix)] {
+			du.Orphans = append(du.Orphans, p)
+			du.OrphanBytes += size
+		}
+	}
+	sort.Strings(du.Orphans)
+	return du, nil
+}
+
+func (du *diskUsage) print(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LANGUAGE\tREPOSITORIES\tPRESENT\tSIZE\tMISSING\tMISSING SIZE")
+	langs := make([]string, 0, len(du.Languages))
+	for lang := range du.Languages {
+		langs = append(langs, lang)
+	}
+	sort.Slice(langs, func(i, j int) bool {
+		a, b := du.Languages[langs[i]], du.Languages[langs[j]]
+		if a.PresentBytes != b.PresentBytes {
+			return a.PresentBytes > b.PresentBytes
+		}
+		return langs[i] < langs[j]
+	})
+	for _, lang := range langs {
+		u := du.Languages[lang]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%d\t%s\n", lang, u.Repositories, u.Present,
+			humanize.Bytes(uint64(u.PresentBytes)), u.Missing, humanize.Bytes(uint64(u.MissingBytes)))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintln(w)
+	fmt.Fprintf(w, "files:       %d\n", du.Files)
+	fmt.Fprintf(w, "present:     %d (%s)\n", du.Present, humanize.Bytes(uint64(du.PresentBytes)))
+	if du.Mismatched > 0 {
+		fmt.Fprintf(w, "wrong size:  %d\n", du.Mismatched)
+	}
+	fmt.Fprintf(w, "missing:     %d (%s known)\n", du.Missing, humanize.Bytes(uint64(du.MissingBytes)))
+	_, err := fmt.Fprintf(w, "orphans:     %d (%s)\n", len(du.Orphans), humanize.Bytes(uint64(du.OrphanBytes)))
+	return err
+}
+
+// duCmd represents the du command
+var duCmd = &cobra.Command{
+	Use:   "du",
+	Short: "compare the downloaded files with the index",
+	Long: `Compares the files of a dataset in the output location with its index, use
+flags to filter the repositories reported.
+
+Reports the files present and their size for each language, as well as the
+missing files. Files under <dataset>/<version>/ which no repository of the
+index references are orphans: --list-orphans prints them and --delete-orphans
+removes them. With --other-versions the files of the other versions of the
+dataset are orphans too. Interrupted downloads are never orphans.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		dataset, err := handleDatasetArg(cmd.Use, flags)
+		if err != nil {
+			return err
+		}
+		dest, err := FileSystemFromFlags(flags)
+		if err != nil {
+			return err
+		}
+		listOrphans, err := flags.GetBool("list-orphans")
+		if err != nil {
+			return err
+		}
+		deleteOrphans, err := flags.GetBool("delete-orphans")
+		if err != nil {
+			return err
+		}
+		otherVersions, err := flags.GetBool("other-versions")
+		if err != nil {
+			return err
+		}
+		filter, err := filterFromFlags(flags)
+		if err != nil {
+			return err
+		}
+		ctx := setupContext()
+		resolveVersion(ctx, dataset.Name())
+		f, err := getIndex(ctx, dataset.Name())
+		if err != nil {
+			return fmt.Errorf("could not open index file: %v", err)
+		}
+		defer f.Close()
+
+		du, err := computeDiskUsage(ctx, dest, dataset, csv.NewReader(f), filter, otherVersions)
+		if err != nil {
+			return err
+		}
+		if err := du.print(os.Stdout); err != nil {
+			return err
+		}
+		if listOrphans && !deleteOrphans {
+			for _, p := range du.Orphans {
+				fmt.Println(dest.Abs(p))
+			}
+		}
+		if !deleteOrphans {
+			return nil
+		}
+		for _, p := range du.Orphans {
+			if err := dest.Remove(p); err != nil {
+				return fmt.Errorf("could not remove %s: %v", dest.Abs(p), err)
+			}
+			fmt.Printf("removed %s\n", dest.Abs(p))
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(duCmd)
+	flags := duCmd.Flags()
+	addFilterFlags(flags)
+	flags.StringP("output", "o", ".", "path where the siva files are stored")
+	flags.Bool("list-orphans", false, "print the files no repository of the index references")
+	flags.Bool("delete-orphans", false, "remove the files no repository of the index references")
+	flags.Bool("other-versions", false, "count the files of the other versions of the dataset as orphans too")
+}
@@ -0,0 +1,140 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	pb "github.com/cheggaaa/pb/v3"
+	"github.com/sirupsen/logrus"
+)
+
+// Event types.
+const (
+	eventStart    = "start"
+	eventProgress = "progress"
+	eventComplete = "complete"
+	eventRetry    = "retry"
+	eventSkip     = "skip"
+	eventFailure  = "failure"
+)
+
+// eventProgressInterval is how often progress events are written for each
+// file being copied.
+const eventProgressInterval = 10 * time.Second
+
+// event is a machine readable record of what a long command is doing. Events
+// without a file refer to the whole command.
+type event struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Command  string    `json:"command"`
+	File     string    `json:"file,omitempty"`
+	URL      string    `json:"url,omitempty"`
+	Files    int       `json:"files,omitempty"`
+	Failed   int       `json:"failed,omitempty"`
+	Bytes    int64     `json:"bytes,omitempty"`
+	Attempt  int       `json:"attempt,omitempty"`
+	Duration float64   `json:"duration,omitempty"` // in seconds.
+	Error    string    `json:"error,omitempty"`
+}
+
+// eventLog writes events as JSON lines. A nil eventLog discards them.
+type eventLog struct {
+	mu      sync.Mutex
+	e       *json.Encoder
+	command string
+	stderr  bool
+}
+
+// events is the event log of the running command, set up by --events.
+var events *eventLog
+
+// openEventLog returns the event log for the --events and --events-file
+// flags, nil if disabled.
+func openEventLog(command, format, path string) (*eventLog, error) {
+	switch format {
+	case "":
+		if path != "" {
+			return nil, fmt.Errorf("--events-file requires --events")
+		}
+		return nil, nil
+	case "jsonl":
+	default:
+		return nil, fmt.Errorf("unknown format in --events %q (choose from jsonl)", format)
+	}
+	if path == "" || path == "-" {
+		return &eventLog{e: json.NewEncoder(os.Stderr), command: command, stderr: true}, nil
+	}
+	// The file is never closed, the events are written unbuffered.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the event log: %v", err)
+	}
+	return &eventLog{e: json.NewEncoder(f), command: command}, nil
+}
+
+func (l *eventLog) emit(e event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Command = l.command
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.e.Encode(e); err != nil {
+		logrus.Warnf("could not write event: %v", err)
+	}
+}
+
+// finish emits the complete or failure event of an operation started at start.
+func (l *eventLog) finish(e event, start time.Time, err error) {
+	e.Duration = time.Since(start).Seconds()
+	e.Event = eventComplete
+	if err != nil {
+		e.Event = eventFailure
+		e.Error = err.Error()
+	}
+	l.emit(e)
+}
+
+// writer returns w, reporting the bytes written to it in progress events for
+// file when enabled.
+func (l *eventLog) writer(w io.Writer, file string) io.Writer {
+	if l == nil {
+		return w
+	}
+	return &progressWriter{w: w, log: l, file: file, last: time.Now()}
+}
+
+type progressWriter struct {
+	w       io.Writer
+	log     *eventLog
+	file    string
+	written int64
+	last    time.Time
+}
+
+func (w *progressWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.written += int64(n)
+	if now := time.Now(); now.Sub(w.last) >= eventProgressInterval {
+		w.last = now
+		w.log.emit(event{Event: eventProgress, File: w.file, Bytes: w.written})
+	}
+	return n, err
+}
+
+// newProgressBar starts a progress bar, hidden if the events are written to
+// the standard error.
+func newProgressBar(total int) *pb.ProgressBar {
+	bar := pb.New(total)
+	if events != nil && events.stderr {
+		bar.SetWriter(ioutil.Discard)
+	}
+	return bar.Start()
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/md5"
 	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -12,9 +13,11 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/colinmarc/hdfs"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/pflag"
 )
 
@@ -46,11 +49,7 @@ func FileSystemFromFlags(flags *pflag.FlagSet) (FileSystem, error) {
 	case "http", "https":
 		return urlFS(path), nil
 	case "hdfs":
-		client, err := hdfs.New(u.Host)
-		if err != nil {
-			return nil, fmt.Errorf("could not create HDFS client: %v", err)
-		}
-		return hdfsFS{u.Path, client}, nil
+		return newHDFS(u)
 	case "":
 		return localFS(path), nil
 	default:
@@ -70,6 +69,54 @@ func (fs localFS) Rename(oldpath, newpath string) error {
 	return os.Rename(fs.Abs(oldpath), fs.Abs(newpath))
 }
 
+// FreeSpace returns the free space in the disk holding the closest existing
+// parent directory of fs.
+func (fs localFS) FreeSpace() (int64, error) {
+	path, err := filepath.Abs(string(fs))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return diskFree(path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return diskFree(path)
+		}
+		path = parent
+	}
+}
+
+// Walk calls f for each file under dir, with its path relative to fs.
+func (fs localFS) Walk(dir string, f func(path string, size int64) error) error {
+	root := fs.Abs(dir)
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		// Files linked to a content store are reported with the size of the
+		// stored file, or as missing if it is not there.
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = os.Stat(p); os.IsNotExist(err) {
+				return nil
+			} else if err != nil || info.IsDir() {
+				return err
+			}
+		}
+		rel, err := filepath.Rel(string(fs), p)
+		if err != nil {
+			return err
+		}
+		return f(filepath.ToSlash(rel), info.Size())
+	})
+}
+
 func md5Hash(fs FileSystem, path string) (string, error) {
 	rc, err := fs.Open(path)
 	if err != nil {
@@ -134,6 +181,9 @@ func (fs urlFS) header(path string) (http.Header, error) {
 	if err != nil {
 		return nil, err
 	}
+	if res.StatusCode == http.StatusNotFound {
+		return nil, &os.PathError{Op: "head", Path: fs.Abs(path), Err: os.ErrNotExist}
+	}
 	if res.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf(res.Status)
 	}
@@ -166,30 +216,255 @@ func (fs urlFS) Rename(oldpath, newpath string) error {
 	return fmt.Errorf("not implemented for URLs")
 }
 
+// hdfsFS stores the MD5 of the files it creates in .md5 sidecars, as the
+// checksums of HDFS can not be compared with those of the server.
 type hdfsFS struct {
 	path string
 	c    *hdfs.Client
+
+	// replication and blockSize are used to create files if replication is
+	// set, the defaults of the cluster are used otherwise.
+	replication int
+	blockSize   int64
+}
+
+// defaultBlockSize is the default block size of HDFS, used along with a
+// replication factor which is not the default one.
+const defaultBlockSize = 128 * 1024 * 1024
+
+// newHDFS connects to the HDFS cluster of an hdfs:// URL. The Hadoop
+// configuration in $HADOOP_CONF_DIR is used to resolve nameservices, or the
+// default file system if the URL has no host, and provides the replication
+// factor and block size of the files.
+func newHDFS(u *url.URL) (hdfsFS, error) {
+	conf := hdfs.LoadHadoopConf("")
+	namenodes, err := hdfsNamenodes(conf, u.Host)
+	if err != nil {
+		return hdfsFS{}, err
+	}
+	client, err := hdfs.NewClient(hdfs.ClientOptions{Addresses: namenodes})
+	if err != nil {
+		return hdfsFS{}, fmt.Errorf("could not create HDFS client: %v", err)
+	}
+	fs := hdfsFS{path: u.Path, c: client, blockSize: defaultBlockSize}
+	if v := conf["dfs.replication"]; v != "" {
+		if fs.replication, err = strconv.Atoi(v); err != nil || fs.replication <= 0 {
+			return hdfsFS{}, fmt.Errorf("invalid dfs.replication %q in the Hadoop configuration", v)
+		}
+	}
+	if v := conf["dfs.blocksize"]; v != "" {
+		if fs.blockSize, err = parseHadoopSize(v); err != nil {
+			return hdfsFS{}, fmt.Errorf("invalid dfs.blocksize %q in the Hadoop configuration", v)
+		}
+	}
+	return fs, nil
+}
+
+// hdfsNamenodes returns the addresses of the namenodes of host, which is
+// either a namenode address or a nameservice of the configuration. The
+// default file system of the configuration is used if host is empty.
+func hdfsNamenodes(conf hdfs.HadoopConf, host string) ([]string, error) {
+	if host == "" {
+		for _, key := range []string{"fs.defaultFS", "fs.default.name"} {
+			if u, err := url.Parse(conf[key]); err == nil && u.Host != "" {
+				host = u.Host
+				break
+			}
+		}
+	}
+	if host == "" {
+		namenodes, err := conf.Namenodes()
+		if err != nil {
+			return nil, fmt.Errorf("no namenode in the output location nor in the Hadoop configuration, set HADOOP_CONF_DIR")
+		}
+		return namenodes, nil
+	}
+	ids := conf["dfs.ha.namenodes."+host]
+	if ids == "" {
+		return []string{host}, nil
+	}
+	var namenodes []string
+	for _, id := range strings.Split(ids, ",") {
+		if address := conf["dfs.namenode.rpc-address."+host+"."+strings.TrimSpace(id)]; address != "" {
+			namenodes = append(namenodes, address)
+		}
+	}
+	if len(namenodes) == 0 {
+		return nil, fmt.Errorf("no namenode address for the nameservice %s in the Hadoop configuration", host)
+	}
+	return namenodes, nil
+}
+
+// parseHadoopSize parses a size of the Hadoop configuration, in bytes or with
+// one of the k, m, g or t binary suffixes.
+func parseHadoopSize(s string) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("kmgt", s[n-1]); i >= 0 {
+			multiplier = 1 << (10 * uint(i+1))
+			s = s[:n-1]
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * multiplier, nil
 }
 
 func (fs hdfsFS) Abs(path string) string { return fs.path + "/" + path }
 
+// Create creates a file whose MD5 is stored in a sidecar once closed.
 func (fs hdfsFS) Create(path string) (io.WriteCloser, error) {
-	path = fs.Abs(path)
-	dir := filepath.Dir(path)
+	abs := fs.Abs(path)
+	dir := filepath.Dir(abs)
 	if err := fs.c.MkdirAll(dir, os.ModePerm); err != nil && !os.IsExist(err) {
 		return nil, fmt.Errorf("could not create %s: %v", dir, err)
 	}
-	return fs.c.Create(path)
+	var w io.WriteCloser
+	var err error
+	if fs.replication > 0 {
+		w, err = fs.c.CreateFile(abs, fs.replication, fs.blockSize, 0644)
+	} else {
+		w, err = fs.c.Create(abs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &hdfsWriter{WriteCloser: w, fs: fs, path: path, hash: md5.New()}, nil
+}
+
+// hdfsWriter hashes a file while it is written.
+type hdfsWriter struct {
+	io.WriteCloser
+	fs   hdfsFS
+	path string
+	hash hash.Hash
+}
+
+func (w *hdfsWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	w.hash.Write(p[:n])
+	return n, err
+}
+
+func (w *hdfsWriter) Close() error {
+	if err := w.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return w.fs.saveMD5(w.path, hex.EncodeToString(w.hash.Sum(nil)))
+}
+
+// saveMD5 writes the .md5 sidecar of path.
+func (fs hdfsFS) saveMD5(path, hash string) error {
+	sidecar := fs.Abs(path + md5Suffix)
+	if err := fs.c.Remove(sidecar); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	w, err := fs.c.Create(sidecar)
+	if err != nil {
+		return fmt.Errorf("could not create %s: %v", sidecar, err)
+	}
+	if _, err := io.WriteString(w, md5Sidecar(hash, path)); err != nil {
+		_ = w.Close()
+		return err
+	}
+	return w.Close()
+}
+
+// sidecarMD5 returns the hash in the .md5 sidecar of path, if it is not
+// older than the file.
+func (fs hdfsFS) sidecarMD5(path string) (string, error) {
+	info, err := fs.c.Stat(fs.Abs(path))
+	if err != nil {
+		return "", err
+	}
+	sidecar, err := fs.c.Stat(fs.Abs(path + md5Suffix))
+	if err != nil {
+		return "", err
+	}
+	if info.ModTime().After(sidecar.ModTime()) {
+		return "", fmt.Errorf("%s is older than the file", fs.Abs(path+md5Suffix))
+	}
+	b, err := fs.c.ReadFile(fs.Abs(path + md5Suffix))
+	if err != nil {
+		return "", err
+	}
+	fields := bytes.Fields(b)
+	if len(fields) == 0 {
+		return "", fmt.Errorf("%s is empty", fs.Abs(path+md5Suffix))
+	}
+	return string(fields[0]), nil
+}
+
+// MD5 returns the hash in the .md5 sidecar of path. Otherwise the whole file
+// is read to compute it and the sidecar is written for the next time.
+func (fs hdfsFS) MD5(path string) (string, error) {
+	if hash, err := fs.sidecarMD5(path); err == nil {
+		return hash, nil
+	}
+	hash, err := md5Hash(fs, path)
+	if err != nil {
+		return "", err
+	}
+	if err := fs.saveMD5(path, hash); err != nil {
+		logrus.Warnf("could not write the MD5 of %s: %v", fs.Abs(path), err)
+	}
+	return hash, nil
 }
 
 func (fs hdfsFS) Open(path string) (io.ReadCloser, error) { return fs.c.Open(fs.Abs(path)) }
 func (fs hdfsFS) ModTime(path string) (time.Time, error)  { return modtime(fs.c.Stat(fs.Abs(path))) }
 func (fs hdfsFS) Size(path string) (int64, error)         { return size(fs.c.Stat(fs.Abs(path))) }
-func (fs hdfsFS) MD5(path string) (string, error)         { return md5Hash(fs, path) }
-func (fs hdfsFS) Remove(path string) error                { return fs.c.Remove(fs.Abs(path)) }
 
+// Remove removes path and its .md5 sidecar.
+func (fs hdfsFS) Remove(path string) error {
+	if err := fs.c.Remove(fs.Abs(path + md5Suffix)); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("could not remove %s: %v", fs.Abs(path+md5Suffix), err)
+	}
+	return fs.c.Remove(fs.Abs(path))
+}
+
+// Rename renames oldpath and moves the hash in its .md5 sidecar, if any, to
+// the sidecar of newpath.
 func (fs hdfsFS) Rename(oldpath, newpath string) error {
-	return fs.c.Rename(fs.Abs(oldpath), fs.Abs(newpath))
+	hash, herr := fs.sidecarMD5(oldpath)
+	if err := fs.c.Rename(fs.Abs(oldpath), fs.Abs(newpath)); err != nil {
+		return err
+	}
+	if err := fs.c.Remove(fs.Abs(oldpath + md5Suffix)); err != nil && !os.IsNotExist(err) {
+		logrus.Warnf("could not remove %s: %v", fs.Abs(oldpath+md5Suffix), err)
+	}
+	if herr != nil {
+		return nil
+	}
+	return fs.saveMD5(newpath, hash)
+}
+
+// FreeSpace returns the remaining capacity of the HDFS cluster.
+func (fs hdfsFS) FreeSpace() (int64, error) {
+	info, err := fs.c.StatFs()
+	if err != nil {
+		return 0, err
+	}
+	return int64(info.Remaining), nil
+}
+
+// Walk calls f for each file under dir, with its path relative to fs.
+func (fs hdfsFS) Walk(dir string, f func(path string, size int64) error) error {
+	root := fs.Abs(dir)
+	return fs.c.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		return f(strings.TrimPrefix(p, fs.path+"/"), info.Size())
+	})
 }
 
 func modtime(fi os.FileInfo, err error) (time.Time, error) {
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/pflag"
 	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
@@ -30,10 +32,123 @@ func filterFromFlags(flags *pflag.FlagSet) (pga.Filter, error) {
 	}
 	fs = append(fs, f)
 
+	uastFilters, err := uastFiltersFromFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	fs = append(fs, uastFilters...)
+
 	return filters.And(fs...), nil
 }
 
+// uastFilterFlags are the filter flags which only apply to the uast dataset.
+var uastFilterFlags = []string{"min-file-rate", "min-byte-rate", "min-lang-file-rate", "min-lang-byte-rate", "min-lang-files"}
+
+func uastFiltersFromFlags(flags *pflag.FlagSet) ([]pga.Filter, error) {
+	var fs []pga.Filter
+	for _, name := range []string{"min-file-rate", "min-byte-rate"} {
+		rate, err := flags.GetFloat64(name)
+		if err != nil {
+			return nil, err
+		}
+		if rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid --%s %v, it must be between 0 and 1", name, rate)
+		}
+		if rate == 0 {
+			continue
+		}
+		if name == "min-file-rate" {
+			fs = append(fs, filters.MinFileExtractionRate(rate))
+		} else {
+			fs = append(fs, filters.MinByteExtractionRate(rate))
+		}
+	}
+
+	for _, name := range []string{"min-lang-file-rate", "min-lang-byte-rate", "min-lang-files"} {
+		values, err := flags.GetStringSlice(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			i := strings.LastIndex(v, "=")
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid --%s %q, expected language=value", name, v)
+			}
+			lang, value := v[:i], v[i+1:]
+			if name == "min-lang-files" {
+				files, err := strconv.ParseInt(value, 10, 64)
+				if err != nil || files < 0 {
+					return nil, fmt.Errorf("invalid --%s %q, expected language=files", name, v)
+				}
+				fs = append(fs, filters.MinLanguageParsedFiles(lang, files))
+				continue
+			}
+			rate, err := strconv.ParseFloat(value, 64)
+			if err != nil || rate < 0 || rate > 1 {
+				return nil, fmt.Errorf("invalid --%s %q, expected language=rate between 0 and 1", name, v)
+			}
+			if name == "min-lang-file-rate" {
+				fs = append(fs, filters.MinLanguageFileExtractionRate(lang, rate))
+			} else {
+				fs = append(fs, filters.MinLanguageByteExtractionRate(lang, rate))
+			}
+		}
+	}
+	return fs, nil
+}
+
+// checkDatasetFilterFlags returns an error if a filter flag set does not
+// apply to the dataset.
+func checkDatasetFilterFlags(flags *pflag.FlagSet, dataset pga.Dataset) error {
+	if dataset.Name() == "uast" {
+		return nil
+	}
+	for _, name := range uastFilterFlags {
+		if f := flags.Lookup(name); f != nil && isSet(f) {
+			return fmt.Errorf("--%s only applies to the uast dataset", name)
+		}
+	}
+	return nil
+}
+
+// isFilterFlag returns whether name is one of the flags added by addFilterFlags.
+func isFilterFlag(name string) bool {
+	if name == "lang" || name == "url" {
+		return true
+	}
+	for _, f := range uastFilterFlags {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
 func addFilterFlags(flags *pflag.FlagSet) {
+	flags.String("filter", "", "named filter of the configuration file setting the other filter flags")
 	flags.StringSliceP("lang", "l", nil, "list of languages that the repositories should have")
 	flags.StringP("url", "u", "", "regular expression that repo urls need to match")
+	flags.Float64("min-file-rate", 0, "uast only: minimum ratio of files parsed to UASTs")
+	flags.Float64("min-byte-rate", 0, "uast only: minimum ratio of bytes parsed to UASTs")
+	flags.StringSlice("min-lang-file-rate", nil, "uast only: minimum ratio of files of a language parsed to UASTs, e.g. go=0.9")
+	flags.StringSlice("min-lang-byte-rate", nil, "uast only: minimum ratio of bytes of a language parsed to UASTs, e.g. go=0.9")
+	flags.StringSlice("min-lang-files", nil, "uast only: minimum number of files of a language parsed to UASTs, e.g. go=100")
+}
+
+// filterExpression returns the filter flags that were set, explicitly or by
+// the configuration, as they would be written in the command line.
+func filterExpression(flags *pflag.FlagSet) string {
+	var exprs []string
+	for _, name := range append([]string{"lang", "url"}, uastFilterFlags...) {
+		f := flags.Lookup(name)
+		if f == nil || !isSet(f) {
+			continue
+		}
+		value := f.Value.String()
+		if sv, ok := f.Value.(pflag.SliceValue); ok {
+			value = strings.Join(sv.GetSlice(), ",")
+		}
+		exprs = append(exprs, fmt.Sprintf("--%s=%q", name, value))
+	}
+	return strings.Join(exprs, " ")
 }
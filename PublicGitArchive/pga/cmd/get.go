@@ -8,8 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
-	pb "github.com/cheggaaa/pb/v3"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
 )
@@ -22,14 +23,17 @@ var getCmd = &cobra.Command{
 	Short: "gets all the repositories in the index",
 	Long: `Downloads the repositories in the index, use flags to filter the results.
 
-Alternatively, a list of .siva filenames can be passed through standard input.`,
+Alternatively, a list of .siva filenames can be passed through standard input.
+
+With --archive the files are written to a single tar or zip archive, or streamed
+to the standard output, instead of a directory tree.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		dataset, err := handleDatasetArg(cmd.Use, cmd.Flags())
 		if err != nil {
 			return err
 		}
 		ctx := setupContext()
-		source := urlFS(rootURL)
+		source := urlFS(mirrorURL)
 		dest, err := FileSystemFromFlags(cmd.Flags())
 		if err != nil {
 			return err
@@ -38,12 +42,107 @@ Alternatively, a list of .siva filenames can be passed through standard input.`,
 		if err != nil {
 			return err
 		}
+		rate, err := cmd.Flags().GetString("rate-limit")
+		if err != nil {
+			return err
+		}
+		bytesPerSecond, err := parseRate(rate)
+		if err != nil {
+			return fmt.Errorf("invalid --rate-limit: %v", err)
+		}
+		adaptive, err := cmd.Flags().GetBool("adaptive")
+		if err != nil {
+			return err
+		}
+		dryRun, err := cmd.Flags().GetBool("dry-run")
+		if err != nil {
+			return err
+		}
+		force, err := cmd.Flags().GetBool("force")
+		if err != nil {
+			return err
+		}
+		manifestPath, err := cmd.Flags().GetString("manifest")
+		if err != nil {
+			return err
+		}
+		writeManifestPath, err := cmd.Flags().GetString("write-manifest")
+		if err != nil {
+			return err
+		}
+		archivePath, err := cmd.Flags().GetString("archive")
+		if err != nil {
+			return err
+		}
+		archiveFormatName, err := cmd.Flags().GetString("archive-format")
+		if err != nil {
+			return err
+		}
+		withIndex, err := cmd.Flags().GetBool("archive-index")
+		if err != nil {
+			return err
+		}
+		if archivePath != "" {
+			if archiveFormatName, err = archiveFormat(archivePath, archiveFormatName); err != nil {
+				return err
+			}
+			if dryRun {
+				return fmt.Errorf("--archive and --dry-run can not be used together")
+			}
+			// The files are streamed one after another, and a file partly
+			// written to the archive can not be downloaded again.
+			for _, name := range []string{"jobs", "retries", "adaptive"} {
+				if cmd.Flags().Changed(name) {
+					return fmt.Errorf("--%s can not be used with --archive", name)
+				}
+			}
+		} else if withIndex || cmd.Flags().Changed("archive-format") {
+			return fmt.Errorf("--archive-format and --archive-index require --archive")
+		}
+		retries, err := cmd.Flags().GetInt("retries")
+		if err != nil {
+			return err
+		}
+		store, err := storeFromFlags(cmd.Flags(), dest)
+		if err != nil {
+			return err
+		}
+		if store != "" && archivePath != "" {
+			return fmt.Errorf("--store and --archive can not be used together")
+		}
 		var filenames = map[string]struct{}{}
+		var sizes = map[string]int64{}
+		var m *manifest
+		var rows []pga.Repository
 		stdin, err := cmd.Flags().GetBool("stdin")
 		if err != nil {
 			return err
 		}
-		if stdin {
+		if manifestPath != "" {
+			if stdin {
+				return fmt.Errorf("--manifest and --stdin can not be used together")
+			}
+			if withIndex {
+				return fmt.Errorf("--archive-index can not be used with --manifest")
+			}
+			m, err = readManifest(manifestPath)
+			if err != nil {
+				return err
+			}
+			if m.Dataset != dataset.Name() {
+				return fmt.Errorf("manifest %s is for the %s dataset", manifestPath, m.Dataset)
+			}
+			fmt.Fprintf(os.Stderr, "downloading %d files of version %s from manifest %s\n",
+				len(m.Files), m.Version, manifestPath)
+			pgaVersion = m.Version
+			filenames, sizes = m.filenames()
+		} else if resolveVersion(ctx, dataset.Name()); writeManifestPath != "" && pgaVersion == latestVersion {
+			return fmt.Errorf("could not resolve the latest version of %s to write the manifest, use --pga-version",
+				dataset.Name())
+		} else if stdin {
+			if withIndex {
+				return fmt.Errorf("--archive-index can not be used with --stdin")
+			}
 			fmt.Fprintln(os.Stderr, "downloading siva files by name from stdin")
 			fmt.Fprintln(os.Stderr, "filter flags will be ignored")
 			b, err := ioutil.ReadAll(os.Stdin)
@@ -55,6 +154,9 @@ Alternatively, a list of .siva filenames can be passed through standard input.`,
 				if filename == "" {
 					continue
 				}
+				if !validFilename(filename) {
+					return fmt.Errorf("invalid file name %q in standard input", filename)
+				}
 				filenames[filename] = struct{}{}
 			}
 		} else {
@@ -69,38 +171,116 @@ Alternatively, a list of .siva filenames can be passed through standard input.`,
 				return err
 			}
 			addFiles := func(r pga.Repository) error {
-				for _, filename := range r.GetFilenames() {
+				names := r.GetFilenames()
+				for _, filename := range names {
 					filenames[filename] = struct{}{}
 				}
+				if len(names) == 1 && r.GetSize() >= 0 {
+					sizes[names[0]] = r.GetSize()
+				}
+				if withIndex {
+					rows = append(rows, r)
+				}
 				return nil
 			}
 			pga.ForEachRepository(ctx, r, dataset, filter, addFiles)
 		}
 
-		return downloadFilenames(ctx, dest, source, dataset.Name(), filenames, maxDownloads)
+		bw := newRateLimiter(bytesPerSecond)
+		jobs := newConcurrencyLimiter(maxDownloads)
+		if writeManifestPath != "" {
+			filter := "stdin"
+			if m != nil {
+				filter = m.Filter
+			} else if !stdin {
+				filter = filterExpression(cmd.Flags())
+			}
+			wm, err := buildManifest(ctx, source, dataset.Name(), filter, filenames, sizes, jobs)
+			if err != nil {
+				return fmt.Errorf("could not build manifest: %v", err)
+			}
+			if err := wm.write(writeManifestPath); err != nil {
+				return fmt.Errorf("could not write manifest: %v", err)
+			}
+		}
+		if archivePath != "" {
+			if withIndex && rows == nil {
+				rows = []pga.Repository{}
+			}
+			return archiveFilenames(ctx, source, dataset, filenames, rows, m,
+				archivePath, archiveFormatName, bw)
+		}
+		if dryRun || !force {
+			plan, err := planDownload(ctx, dest, source, dataset.Name(), filenames, sizes, jobs, dryRun, store)
+			if err != nil {
+				return err
+			}
+			if dryRun {
+				plan.print(os.Stdout, freeSpace(dest))
+				return nil
+			}
+			if err := checkFreeSpace(dest, plan); err != nil {
+				return err
+			}
+		}
+		if adaptive {
+			// Adapt to the downloads, not to the requests of the plan or the manifest.
+			go jobs.adapt(ctx, bw)
+		}
+		if err := downloadFilenames(ctx, dest, source, dataset.Name(), filenames, jobs, bw, retries, store); err != nil {
+			return err
+		}
+		if m != nil {
+			return m.verify(ctx, dest, jobs)
+		}
+		return nil
 	},
 }
 
+// datasetPath returns the path of a file of the dataset in the server.
+func datasetPath(datasetName, filename string) string {
+	return filepath.Join(datasetName, pgaVersion, filename[:2], filename)
+}
+
+// retryDelay is the delay before the first retry of a failed download, it
+// doubles with every attempt.
+const retryDelay = time.Second
+
+// downloadFilenames downloads the files of the dataset to dest, through the
+// store unless it is empty.
 func downloadFilenames(ctx context.Context, dest, source FileSystem, datasetName string,
-	filenames map[string]struct{}, maxDownloads int) error {
+	filenames map[string]struct{}, jobs *concurrencyLimiter, bw *rateLimiter, retries int,
+	store contentStore) (err error) {
 
-	tokens := make(chan bool, maxDownloads)
-	for i := 0; i < maxDownloads; i++ {
-		tokens <- true
-	}
+	start := time.Now()
+	failed := 0
+	events.emit(event{Event: eventStart, Files: len(filenames)})
+	defer func() {
+		events.finish(event{Files: len(filenames), Failed: failed, Bytes: bw.total()}, start, err)
+	}()
 
 	done := make(chan error)
 	for filename := range filenames {
-		filename := filepath.Join(datasetName, pgaVersion, filename[:2], filename)
+		filename := datasetPath(datasetName, filename)
 		go func() {
-			select {
-			case <-tokens:
-			case <-ctx.Done():
-				return
+			var err error
+			for attempt := 0; attempt <= retries; attempt++ {
+				if attempt > 0 {
+					events.emit(event{Event: eventRetry, File: filename, Attempt: attempt, Error: err.Error()})
+					logrus.Warnf("retrying %s: %v", filename, err)
+					if err = sleep(ctx, retryDelay<<uint(attempt-1)); err != nil {
+						break
+					}
+				}
+				if err = jobs.acquire(ctx); err != nil {
+					break
+				}
+				err = store.update(ctx, dest, source, filename, bw)
+				jobs.release(err)
+				if _, cancel := err.(*pga.CommandCanceledError); err == nil || cancel {
+					break
+				}
 			}
-			defer func() { tokens <- true }()
-
-			err := updateCache(ctx, dest, source, filename)
 			if _, cancel := err.(*pga.CommandCanceledError); err != nil && !cancel {
 				err = fmt.Errorf("could not get %s: %v", filename, err)
 			}
@@ -108,20 +288,40 @@ func downloadFilenames(ctx context.Context, dest, source FileSystem, datasetName
 		}()
 	}
 
-	bar := pb.StartNew(len(filenames))
-	var err error
+	// Every result is waited for, and the first failure is kept so that a
+	// later success does not hide it.
+	var firstErr, cancelErr error
+	bar := newProgressBar(len(filenames))
 	for i := 1; i <= len(filenames); i++ {
-		err = <-done
-		if err != nil {
-			if _, cancel := err.(*pga.CommandCanceledError); !cancel {
-				err = fmt.Errorf("there where failed downloads: %s", err)
-			}
-		} else {
+		err := <-done
+		if err == nil {
 			bar.Increment()
+		} else if _, cancel := err.(*pga.CommandCanceledError); cancel {
+			cancelErr = err
+		} else {
+			failed++
+			if firstErr == nil {
+				firstErr = err
+			}
 		}
 	}
 	bar.Finish()
-	return err
+	if failed > 0 {
+		return fmt.Errorf("%d of %d downloads failed, the first: %v", failed, len(filenames), firstErr)
+	}
+	return cancelErr
+}
+
+// sleep waits for d unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return &pga.CommandCanceledError{}
+	}
 }
 
 func init() {
@@ -130,5 +330,16 @@ func init() {
 	addFilterFlags(flags)
 	flags.StringP("output", "o", ".", "path where the siva files should be stored")
 	flags.IntP("jobs", "j", 10, "number of concurrent gets allowed")
+	flags.String("rate-limit", "", "maximum total download rate shared by all jobs, e.g. 200MB/s")
+	flags.Int("retries", 0, "number of times a failed download is retried")
+	flags.String("store", "", "directory of a content-addressed store shared by the versions the files are linked to")
+	flags.Bool("adaptive", false, "adjust the number of concurrent gets, up to --jobs, to the observed throughput and errors")
 	flags.BoolP("stdin", "i", false, "take list of siva files from standard input")
+	flags.Bool("dry-run", false, "only report how many files and bytes would be downloaded")
+	flags.Bool("force", false, "download even if the destination seems to lack free space")
+	flags.String("manifest", "", "download exactly the files in the given manifest and verify their checksums")
+	flags.String("write-manifest", "", "write a manifest of the selected files to the given path")
+	flags.String("archive", "", "write the files to a single archive at the given path, or - for the standard output, instead of --output")
+	flags.String("archive-format", "", "format of --archive, tar or zip, by default zip if the path ends in .zip and tar otherwise")
+	flags.Bool("archive-index", false, "include the index rows of the selected repositories in --archive")
 }
@@ -0,0 +1,223 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"crypto/md5"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+)
+
+// archiveWriter writes the downloaded files to an archive stream.
+type archiveWriter interface {
+	Create(name string, size int64, modTime time.Time) (io.Writer, error)
+	Close() error
+}
+
+type tarArchiveWriter struct{ w *tar.Writer }
+
+func (w tarArchiveWriter) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	err := w.w.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	return w.w, err
+}
+
+func (w tarArchiveWriter) Close() error { return w.w.Close() }
+
+type zipArchiveWriter struct{ w *zip.Writer }
+
+func (w zipArchiveWriter) Create(name string, size int64, modTime time.Time) (io.Writer, error) {
+	// Siva and Parquet files are already compressed.
+	h := &zip.FileHeader{Name: name, Method: zip.Store, Modified: modTime}
+	h.SetMode(0644)
+	return w.w.CreateHeader(h)
+}
+
+func (w zipArchiveWriter) Close() error { return w.w.Close() }
+
+// archiveFormat returns the format given with --archive-format, or the one
+// of the extension of the archive path, tar by default.
+func archiveFormat(archivePath, format string) (string, error) {
+	switch format {
+	case "tar", "zip":
+		return format, nil
+	case "":
+		if strings.HasSuffix(archivePath, ".zip") {
+			return "zip", nil
+		}
+		return "tar", nil
+	default:
+		return "", fmt.Errorf("unknown format in --archive-format %q (choose from tar, zip)", format)
+	}
+}
+
+func newArchiveWriter(format string, w io.Writer) archiveWriter {
+	if format == "zip" {
+		return zipArchiveWriter{zip.NewWriter(w)}
+	}
+	return tarArchiveWriter{tar.NewWriter(w)}
+}
+
+// csvHeaders returns the columns of the CSV index of a dataset.
+func csvHeaders(dataset pga.Dataset) []string {
+	if dataset.Name() == "uast" {
+		return pga.UastCSVHeaders()
+	}
+	return pga.SivaCSVHeaders()
+}
+
+// archiveFilenames writes the files of the dataset to an archive at
+// archivePath, or to the standard output if it is "-", with the same paths
+// they have in the server. If rows is not nil, the matching index rows are
+// written first to <dataset>/<version>/index.csv. If m is not nil, the md5
+// hash of every file is checked against it.
+func archiveFilenames(ctx context.Context, source FileSystem, dataset pga.Dataset,
+	filenames map[string]struct{}, rows []pga.Repository, m *manifest,
+	archivePath, format string, bw *rateLimiter) (err error) {
+
+	var out io.Writer = os.Stdout
+	if archivePath != "-" {
+		f, err := os.Create(archivePath)
+		if err != nil {
+			return fmt.Errorf("could not create %s: %v", archivePath, err)
+		}
+		defer func() {
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+		}()
+		out = f
+	}
+	w := newArchiveWriter(format, out)
+
+	if rows != nil {
+		if err := archiveIndex(w, dataset, rows); err != nil {
+			return fmt.Errorf("could not write the index rows: %v", err)
+		}
+	}
+
+	files := map[string]manifestFile{}
+	if m != nil {
+		for _, f := range m.Files {
+			files[f.Name] = f
+		}
+	}
+	names := make([]string, 0, len(filenames))
+	for filename := range filenames {
+		names = append(names, filename)
+	}
+	sort.Strings(names)
+
+	start := time.Now()
+	events.emit(event{Event: eventStart, Files: len(names)})
+	defer func() {
+		events.finish(event{Files: len(names), Bytes: bw.total()}, start, err)
+	}()
+	bar := newProgressBar(len(names))
+	defer bar.Finish()
+	for _, filename := range names {
+		f, ok := files[filename]
+		if !ok {
+			f = manifestFile{Name: filename}
+		}
+		if err := archiveFile(ctx, w, source, dataset.Name(), f, bw); err != nil {
+			if _, cancel := err.(*pga.CommandCanceledError); cancel {
+				return err
+			}
+			return fmt.Errorf("could not get %s: %v", filename, err)
+		}
+		bar.Increment()
+	}
+	return w.Close()
+}
+
+func archiveIndex(w archiveWriter, dataset pga.Dataset, rows []pga.Repository) error {
+	var b strings.Builder
+	cw := csv.NewWriter(&b)
+	if err := cw.Write(csvHeaders(dataset)); err != nil {
+		return err
+	}
+	for _, r := range rows {
+		if err := cw.Write(r.ToCSV()); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	name := path.Join(dataset.Name(), pgaVersion, "index.csv")
+	fw, err := w.Create(name, int64(b.Len()), time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(fw, b.String())
+	return err
+}
+
+// archiveFile copies a file of the dataset from the source to the archive,
+// checking its md5 hash if known. Tar needs the exact size in advance, so it
+// is always requested to the source.
+func archiveFile(ctx context.Context, w archiveWriter, source FileSystem, datasetName string,
+	f manifestFile, bw *rateLimiter) (err error) {
+
+	filename, size := f.Name, int64(-1)
+	name := datasetPath(datasetName, filename)
+	start := time.Now()
+	events.emit(event{Event: eventStart, File: name})
+	written := &countingWriter{}
+	defer func() {
+		events.finish(event{File: name, Bytes: written.n}, start, err)
+	}()
+	if _, isZip := w.(zipArchiveWriter); !isZip {
+		var err error
+		if size, err = source.Size(name); err != nil {
+			return err
+		}
+	}
+	modTime, err := source.ModTime(name)
+	if err != nil {
+		modTime = time.Now()
+	}
+
+	rc, err := source.Open(name)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	fw, err := w.Create(path.Join(datasetName, pgaVersion, filename[:2], filename), size, modTime)
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	if err := cancelableCopy(ctx, events.writer(io.MultiWriter(fw, h, written), name), rc, bw); err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); f.MD5 != "" && sum != f.MD5 {
+		return fmt.Errorf("md5 hash %s does not match the manifest %s", sum, f.MD5)
+	}
+	return nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct{ n int64 }
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
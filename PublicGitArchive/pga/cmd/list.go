@@ -23,6 +23,7 @@ var listCmd = &cobra.Command{
 			return err
 		}
 		ctx := setupContext()
+		resolveVersion(ctx, dataset.Name())
 		f, err := getIndex(ctx, dataset.Name())
 		if err != nil {
 			return fmt.Errorf("could not open index file: %v", err)
@@ -38,7 +39,9 @@ var listCmd = &cobra.Command{
 			return err
 		}
 		printRepository := func(r pga.Repository) error {
-			if s, err := formatter(r); err != nil {
+			if s, err := formatter(r); err != nil && events != nil {
+				events.emit(event{Event: eventFailure, URL: r.GetURL(), Error: err.Error()})
+			} else if err != nil {
 				fmt.Fprintf(os.Stderr, "could not format repository %s: %v\n", r.GetURL(), err)
 			} else {
 				fmt.Print(s)
@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// manifest records an exact set of files of a dataset version, so that it
+// can be downloaded again and verified later on.
+type manifest struct {
+	Dataset string         `json:"dataset"`
+	Version string         `json:"version"`
+	Filter  string         `json:"filter,omitempty"`
+	Files   []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	MD5  string `json:"md5"`
+}
+
+func readManifest(path string) (*manifest, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read manifest: %v", err)
+	}
+	var m manifest
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, fmt.Errorf("could not parse manifest %s: %v", path, err)
+	}
+	if m.Dataset == "" || m.Version == "" {
+		return nil, fmt.Errorf("manifest %s lacks the dataset or the version", path)
+	}
+	if strings.ContainsAny(m.Version, `/\`) || strings.Contains(m.Version, "..") {
+		return nil, fmt.Errorf("invalid version %q in manifest %s", m.Version, path)
+	}
+	for _, f := range m.Files {
+		if !validFilename(f.Name) {
+			return nil, fmt.Errorf("invalid file name %q in manifest %s", f.Name, path)
+		}
+	}
+	return &m, nil
+}
+
+// validFilename returns whether name can be the name of a file of a dataset:
+// a plain base name with at least the two characters of its directory.
+func validFilename(name string) bool {
+	return len(name) >= 2 && name != ".." && !strings.ContainsAny(name, `/\`)
+}
+
+func (m *manifest) write(path string) error {
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0644)
+}
+
+// filenames returns the set of files in the manifest and their sizes.
+func (m *manifest) filenames() (map[string]struct{}, map[string]int64) {
+	filenames := make(map[string]struct{}, len(m.Files))
+	sizes := make(map[string]int64, len(m.Files))
+	for _, f := range m.Files {
+		filenames[f.Name] = struct{}{}
+		sizes[f.Name] = f.Size
+	}
+	return filenames, sizes
+}
+
+// buildManifest gets the size and md5 hash of every file from the source.
+func buildManifest(ctx context.Context, source FileSystem, datasetName, filter string,
+	filenames map[string]struct{}, knownSizes map[string]int64,
+	jobs *concurrencyLimiter) (*manifest, error) {
+
+	m := &manifest{Dataset: datasetName, Version: pgaVersion, Filter: filter}
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		errs []error
+	)
+	for filename := range filenames {
+		filename := filename
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := jobs.acquire(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			defer jobs.release(nil)
+
+			path := datasetPath(datasetName, filename)
+			size, ok := knownSizes[filename]
+			var err error
+			if !ok {
+				size, err = source.Size(path)
+			}
+			var hash string
+			if err == nil {
+				hash, err = source.MD5(path)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("could not get %s: %v", source.Abs(path), err))
+				return
+			}
+			m.Files = append(m.Files, manifestFile{Name: filename, Size: size, MD5: hash})
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	sort.Slice(m.Files, func(i, j int) bool { return m.Files[i].Name < m.Files[j].Name })
+	return m, nil
+}
+
+// verify checks that every file in the manifest is present in dest with the
+// expected md5 hash.
+func (m *manifest) verify(ctx context.Context, dest FileSystem, jobs *concurrencyLimiter) error {
+	var (
+		mu  sync.Mutex
+		wg  sync.WaitGroup
+		bad []string
+		err error
+	)
+	for _, f := range m.Files {
+		f := f
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if aerr := jobs.acquire(ctx); aerr != nil {
+				mu.Lock()
+				err = aerr
+				mu.Unlock()
+				return
+			}
+			defer jobs.release(nil)
+
+			hash, herr := dest.MD5(datasetPath(m.Dataset, f.Name))
+			if herr == nil && hash == f.MD5 {
+				return
+			}
+			mu.Lock()
+			bad = append(bad, f.Name)
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if len(bad) > 0 {
+		sort.Strings(bad)
+		return fmt.Errorf("%d files do not match the manifest checksums, e.g. %s", len(bad), bad[0])
+	}
+	return nil
+}
@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+)
+
+const md5Suffix = ".md5"
+
+var mirrorActions = map[string]func(flags *pflag.FlagSet, dir string, datasets []pga.Dataset) error{
+	"serve": mirrorServe,
+	"sync":  mirrorSync,
+}
+
+// mirrorServer serves a mirror directory with the layout of the server:
+// csv/<dataset>/ for the indexes and <dataset>/<version>/<xx>/ for the files.
+// The MD5 of the files without a .md5 sidecar is computed on the first
+// request.
+type mirrorServer struct {
+	dir string
+
+	mu     sync.Mutex
+	hashes map[string]cachedHash
+}
+
+// cachedHash is the MD5 of a file, valid while it is not modified.
+type cachedHash struct {
+	modTime time.Time
+	size    int64
+	hash    string
+}
+
+func (s *mirrorServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logrus.Debugf("%s %s", req.Method, req.URL)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := path.Clean("/" + req.URL.Path)
+	fileName := filepath.Join(s.dir, filepath.FromSlash(name))
+	info, err := os.Stat(fileName)
+	if os.IsNotExist(err) && strings.HasSuffix(name, md5Suffix) {
+		s.serveHash(w, req, strings.TrimSuffix(fileName, md5Suffix))
+		return
+	} else if os.IsNotExist(err) || (err == nil && info.IsDir()) {
+		http.NotFound(w, req)
+		return
+	} else if err != nil {
+		logrus.Errorf("%s: %v", fileName, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	if strings.HasSuffix(name, md5Suffix) && staleSidecar(strings.TrimSuffix(fileName, md5Suffix), info) {
+		s.serveHash(w, req, strings.TrimSuffix(fileName, md5Suffix))
+		return
+	}
+
+	f, err := os.Open(fileName)
+	if err != nil {
+		logrus.Errorf("%s: %v", fileName, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	// ServeContent sets Last-Modified and Content-Length and handles ranges.
+	http.ServeContent(w, req, filepath.Base(fileName), info.ModTime(), f)
+}
+
+// staleSidecar returns whether the .md5 sidecar of fileName is older than it.
+func staleSidecar(fileName string, sidecar os.FileInfo) bool {
+	info, err := os.Stat(fileName)
+	return err == nil && info.ModTime().After(sidecar.ModTime())
+}
+
+func (s *mirrorServer) serveHash(w http.ResponseWriter, req *http.Request, fileName string) {
+	info, err := os.Stat(fileName)
+	if err != nil || info.IsDir() {
+		http.NotFound(w, req)
+		return
+	}
+	hash, err := s.hash(fileName, info)
+	if err != nil {
+		logrus.Errorf("could not hash %s: %v", fileName, err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+	content := md5Sidecar(hash, fileName)
+	http.ServeContent(w, req, filepath.Base(fileName)+md5Suffix, info.ModTime(), strings.NewReader(content))
+}
+
+func (s *mirrorServer) hash(fileName string, info os.FileInfo) (string, error) {
+	s.mu.Lock()
+	cached, ok := s.hashes[fileName]
+	s.mu.Unlock()
+	if ok && cached.modTime.Equal(info.ModTime()) && cached.size == info.Size() {
+		return cached.hash, nil
+	}
+	hash, err := md5Hash(localFS(filepath.Dir(fileName)), filepath.Base(fileName))
+	if err != nil {
+		return "", err
+	}
+	s.mu.Lock()
+	s.hashes[fileName] = cachedHash{modTime: info.ModTime(), size: info.Size(), hash: hash}
+	s.mu.Unlock()
+	return hash, nil
+}
+
+// md5Sidecar returns the contents of a .md5 file, in the format of md5sum.
+func md5Sidecar(hash, fileName string) string {
+	return fmt.Sprintf("%s  %s\n", hash, filepath.Base(fileName))
+}
+
+func mirrorServe(flags *pflag.FlagSet, dir string, datasets []pga.Dataset) error {
+	address, err := flags.GetString("address")
+	if err != nil {
+		return err
+	}
+	if info, err := os.Stat(dir); err != nil {
+		return err
+	} else if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	logrus.Infof("serving %s on http://%s, use it with --mirror", dir, address)
+	return http.ListenAndServe(address, &mirrorServer{dir: dir, hashes: map[string]cachedHash{}})
+}
+
+// mirroredFilenames returns the names of the files of the dataset version
+// already in the mirror.
+func mirroredFilenames(dest localFS, datasetName string) (map[string]struct{}, error) {
+	root := dest.Abs(filepath.Join(datasetName, pgaVersion))
+	filenames := map[string]struct{}{}
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if os.IsNotExist(err) && p == root {
+			return filepath.SkipDir
+		} else if err != nil {
+			return err
+		}
+		name := info.Name()
+		if !info.IsDir() && !strings.HasSuffix(name, md5Suffix) && !strings.HasSuffix(name, ".tmp") {
+			filenames[name] = struct{}{}
+		}
+		return nil
+	})
+	return filenames, err
+}
+
+// writeSidecar writes the .md5 file of name unless there is an up to date
+// one. Missing files are skipped, failed downloads were already reported.
+func writeSidecar(dest localFS, name string) error {
+	info, err := os.Stat(dest.Abs(name))
+	if err != nil {
+		return nil
+	}
+	if sidecar, err := os.Stat(dest.Abs(name + md5Suffix)); err == nil && !info.ModTime().After(sidecar.ModTime()) {
+		return nil
+	}
+	hash, err := dest.MD5(name)
+	if err != nil {
+		return fmt.Errorf("could not hash %s: %v", dest.Abs(name), err)
+	}
+	return ioutil.WriteFile(dest.Abs(name+md5Suffix), []byte(md5Sidecar(hash, name)), 0644)
+}
+
+// mirrorSync updates the version catalog and the index of each dataset in
+// the mirror, and the files already mirrored or selected by the filters.
+func mirrorSync(flags *pflag.FlagSet, dir string, datasets []pga.Dataset) error {
+	maxDownloads, err := flags.GetInt("jobs")
+	if err != nil {
+		return err
+	}
+	rate, err := flags.GetString("rate-limit")
+	if err != nil {
+		return err
+	}
+	bytesPerSecond, err := parseRate(rate)
+	if err != nil {
+		return fmt.Errorf("invalid --rate-limit: %v", err)
+	}
+	retries, err := flags.GetInt("retries")
+	if err != nil {
+		return err
+	}
+	filtered := filterExpression(flags) != ""
+	filter, err := filterFromFlags(flags)
+	if err != nil {
+		return err
+	}
+
+	ctx := setupContext()
+	dest := localFS(dir)
+	source := urlFS(mirrorURL)
+	bw := newRateLimiter(bytesPerSecond)
+	jobs := newConcurrencyLimiter(maxDownloads)
+	for _, dataset := range datasets {
+		selected := filtered
+		if err := checkDatasetFilterFlags(flags, dataset); err != nil {
+			if len(datasets) == 1 {
+				return err
+			}
+			logrus.Warnf("only syncing the %s files already mirrored: %v", dataset.Name(), err)
+			selected = false
+		}
+		csvDest := localFS(dest.Abs(filepath.Join("csv", dataset.Name())))
+		csvSource, err := indexSource(dataset.Name())
+		if err != nil {
+			return err
+		}
+		if err := updateCache(ctx, csvDest, csvSource, catalogName, nil); err != nil {
+			logrus.Warnf("could not sync the %s version catalog: %v", dataset.Name(), err)
+		}
+		resolveVersion(ctx, dataset.Name())
+		if err := updateCache(ctx, csvDest, csvSource, indexName, nil); err != nil {
+			return fmt.Errorf("could not sync the %s index: %v", dataset.Name(), err)
+		}
+		for _, name := range []string{catalogName, indexName} {
+			if err := writeSidecar(csvDest, name); err != nil {
+				return err
+			}
+		}
+
+		filenames, err := mirroredFilenames(dest, dataset.Name())
+		if err != nil {
+			return err
+		}
+		if selected {
+			f, err := csvDest.Open(indexName)
+			if err != nil {
+				return err
+			}
+			gz, err := gzip.NewReader(f)
+			if err != nil {
+				_ = f.Close()
+				return fmt.Errorf("could not open index file: %v", err)
+			}
+			err = pga.ForEachRepository(ctx, csv.NewReader(gz), dataset, filter, func(r pga.Repository) error {
+				for _, filename := range r.GetFilenames() {
+					filenames[filename] = struct{}{}
+				}
+				return nil
+			})
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
+		}
+
+		fmt.Fprintf(os.Stderr, "syncing %d %s files of version %s\n", len(filenames), dataset.Name(), pgaVersion)
+		err = downloadFilenames(ctx, dest, source, dataset.Name(), filenames, jobs, bw, retries, "")
+		for filename := range filenames {
+			if serr := writeSidecar(dest, datasetPath(dataset.Name(), filename)); err == nil {
+				err = serr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mirrorCmd represents the set of commands to host a mirror of the server.
+var mirrorCmd = &cobra.Command{
+	Use:   "mirror",
+	Short: "host a mirror of the datasets",
+	Long: `Serve or sync a mirror of the server holding a subset of the datasets, so that
+a team can share a single copy of it, e.g. with pga get --mirror http://host:8080.
+
+The mirror directory has the same layout as the server: the version catalogs and
+the indexes in csv/<dataset>/ and the files in <dataset>/<version>/<xx>/.
+
+serve serves the mirror directory over HTTP, with the .md5 files pga uses to
+check whether a file changed; they are computed if missing. It only listens on
+localhost unless another --address is given.
+
+sync updates the version catalog, the index and the files already in the mirror
+from the server given with --mirror, plus the files of the repositories selected
+by --lang and --url if given, and writes their .md5 files. It applies to all the
+datasets unless one is given.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		if flags.NArg() < 2 || flags.NArg() > 3 {
+			return fmt.Errorf("usage: pga mirror <action> /path/to/mirror [dataset]")
+		}
+		action := flags.Arg(0)
+		actionFunc, exists := mirrorActions[action]
+		if !exists {
+			knownActions := make([]string, 0, len(mirrorActions))
+			for k := range mirrorActions {
+				knownActions = append(knownActions, k)
+			}
+			sort.Strings(knownActions)
+			return fmt.Errorf("unknown action: %s (choose from %s)",
+				action, strings.Join(knownActions, ", "))
+		}
+		datasets := pga.Datasets
+		if flags.NArg() == 3 {
+			dataset, err := datasetByName(flags.Arg(2))
+			if err != nil {
+				return err
+			}
+			datasets = []pga.Dataset{dataset}
+		}
+		return actionFunc(flags, flags.Arg(1), datasets)
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(mirrorCmd)
+	flags := mirrorCmd.Flags()
+	addFilterFlags(flags)
+	flags.StringP("address", "a", "localhost:8080", "address to serve the mirror on, e.g. :8080 for all the interfaces")
+	flags.IntP("jobs", "j", 10, "number of concurrent gets allowed")
+	flags.String("rate-limit", "", "maximum total download rate shared by all jobs, e.g. 200MB/s")
+	flags.Int("retries", 0, "number of times a failed download is retried")
+}
@@ -0,0 +1,150 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	humanize "github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+)
+
+// downloadPlan summarizes what a download would transfer.
+type downloadPlan struct {
+	Files        int
+	TotalBytes   int64
+	Present      int
+	PresentBytes int64
+	Linked       int // files linked from the content store.
+	LinkedBytes  int64
+	Fetch        int
+	FetchBytes   int64
+	Unknown      int // files whose size could not be determined.
+}
+
+// planDownload computes the size of each of the given files and checks which
+// ones are already present in dest. Sizes come from knownSizes when possible
+// and are otherwise requested to the source. When checkHashes is true, files
+// are considered present only if upToDate says so, otherwise a file of the
+// expected size in dest is enough. The files missing in dest but held by the
+// store are linked rather than fetched.
+func planDownload(ctx context.Context, dest, source FileSystem, datasetName string,
+	filenames map[string]struct{}, knownSizes map[string]int64,
+	jobs *concurrencyLimiter, checkHashes bool, store contentStore) (*downloadPlan, error) {
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		plan = &downloadPlan{Files: len(filenames)}
+		errs []error
+	)
+	for filename := range filenames {
+		size, ok := knownSizes[filename]
+		if !ok {
+			size = -1
+		}
+		filename := datasetPath(datasetName, filename)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := jobs.acquire(ctx); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+				return
+			}
+			defer jobs.release(nil)
+
+			if size < 0 {
+				var err error
+				size, err = source.Size(filename)
+				if err != nil {
+					logrus.Warnf("could not get the size of %s: %v", source.Abs(filename), err)
+					size = -1
+				}
+			}
+
+			var present bool
+			if checkHashes {
+				present = upToDate(dest, source, filename)
+			} else if size >= 0 {
+				destSize, err := dest.Size(filename)
+				present = err == nil && destSize == size
+			}
+			var linked bool
+			if !present {
+				linked, _ = store.has(source, filename)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if size < 0 {
+				plan.Unknown++
+				size = 0
+			}
+			plan.TotalBytes += size
+			if present {
+				plan.Present++
+				plan.PresentBytes += size
+			} else if linked {
+				plan.Linked++
+				plan.LinkedBytes += size
+			} else {
+				plan.Fetch++
+				plan.FetchBytes += size
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return plan, nil
+}
+
+func (p *downloadPlan) print(w io.Writer, free int64) {
+	fmt.Fprintf(w, "files:       %d (%s)\n", p.Files, humanize.Bytes(uint64(p.TotalBytes)))
+	fmt.Fprintf(w, "up to date:  %d (%s)\n", p.Present, humanize.Bytes(uint64(p.PresentBytes)))
+	if p.Linked > 0 {
+		fmt.Fprintf(w, "from store:  %d (%s)\n", p.Linked, humanize.Bytes(uint64(p.LinkedBytes)))
+	}
+	fmt.Fprintf(w, "to fetch:    %d (%s)\n", p.Fetch, humanize.Bytes(uint64(p.FetchBytes)))
+	if p.Unknown > 0 {
+		fmt.Fprintf(w, "unknown size: %d\n", p.Unknown)
+	}
+	if free >= 0 {
+		fmt.Fprintf(w, "free space:  %s\n", humanize.Bytes(uint64(free)))
+	}
+}
+
+// freeSpacer is implemented by the file systems able to report how many
+// bytes can still be written to them.
+type freeSpacer interface {
+	FreeSpace() (int64, error)
+}
+
+// freeSpace returns the free space in fs, or -1 when it can not be known.
+func freeSpace(fs FileSystem) int64 {
+	fser, ok := fs.(freeSpacer)
+	if !ok {
+		return -1
+	}
+	free, err := fser.FreeSpace()
+	if err != nil {
+		logrus.Warnf("could not get the free space in %s: %v", fs.Abs(""), err)
+		return -1
+	}
+	return free
+}
+
+// checkFreeSpace returns an error when plan needs more bytes than available in dest.
+func checkFreeSpace(dest FileSystem, plan *downloadPlan) error {
+	free := freeSpace(dest)
+	if free < 0 || plan.FetchBytes <= free {
+		return nil
+	}
+	return fmt.Errorf("not enough free space in %s: %s needed but only %s available (use --force to ignore)",
+		dest.Abs(""), humanize.Bytes(uint64(plan.FetchBytes)), humanize.Bytes(uint64(free)))
+}
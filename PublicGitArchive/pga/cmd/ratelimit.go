@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+)
+
+// rateLimiter caps the number of bytes per second shared by all the
+// concurrent copies, and keeps track of the total number of bytes copied.
+// A rate of zero means no limit.
+type rateLimiter struct {
+	rate        float64
+	transferred int64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{rate: float64(bytesPerSecond), last: time.Now()}
+}
+
+// wait accounts for n bytes already copied and blocks for as long as needed
+// to keep the average rate under the limit.
+func (l *rateLimiter) wait(ctx context.Context, n int64) error {
+	if l == nil {
+		return nil
+	}
+	atomic.AddInt64(&l.transferred, n)
+	if l.rate <= 0 {
+		return nil
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		// do not allow bursts of more than one second worth of bytes.
+		l.tokens = l.rate
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return &pga.CommandCanceledError{}
+	}
+}
+
+// total returns the number of bytes copied so far.
+func (l *rateLimiter) total() int64 {
+	if l == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&l.transferred)
+}
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"K":   1000,
+	"KB":  1000,
+	"M":   1000 * 1000,
+	"MB":  1000 * 1000,
+	"G":   1000 * 1000 * 1000,
+	"GB":  1000 * 1000 * 1000,
+	"T":   1000 * 1000 * 1000 * 1000,
+	"TB":  1000 * 1000 * 1000 * 1000,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// parseBytes parses human readable sizes such as 200MB, 1.5GiB or 1024.
+func parseBytes(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	i := strings.IndexFunc(s, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	num, unit := s, ""
+	if i >= 0 {
+		num, unit = s[:i], strings.ToUpper(strings.TrimSpace(s[i:]))
+	}
+	v, err := strconv.ParseFloat(num, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	mult, ok := byteUnits[unit]
+	if !ok {
+		return 0, fmt.Errorf("unknown unit %q in %q", unit, s)
+	}
+	return int64(v * float64(mult)), nil
+}
+
+// parseRate parses a transfer rate such as 200MB/s. The /s suffix is optional
+// and, like the units, case insensitive.
+func parseRate(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	s = strings.TrimSpace(s)
+	if strings.HasSuffix(strings.ToLower(s), "/s") {
+		s = s[:len(s)-2]
+	}
+	return parseBytes(s)
+}
+
+// concurrencyLimiter limits the number of concurrent downloads. In adaptive
+// mode the limit moves between 1 and max depending on the observed throughput
+// and on the number of failed downloads.
+type concurrencyLimiter struct {
+	mu     sync.Mutex
+	limit  int
+	max    int
+	active int
+	errors int
+	wake   chan struct{}
+}
+
+func newConcurrencyLimiter(limit int) *concurrencyLimiter {
+	if limit < 1 {
+		limit = 1
+	}
+	return &concurrencyLimiter{limit: limit, max: limit, wake: make(chan struct{})}
+}
+
+// acquire blocks until a download slot is free.
+func (l *concurrencyLimiter) acquire(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		if l.active < l.limit {
+			l.active++
+			l.mu.Unlock()
+			return nil
+		}
+		wake := l.wake
+		l.mu.Unlock()
+
+		select {
+		case <-wake:
+		case <-ctx.Done():
+			return &pga.CommandCanceledError{}
+		}
+	}
+}
+
+// release frees a download slot, err is the result of the download.
+func (l *concurrencyLimiter) release(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	if _, cancel := err.(*pga.CommandCanceledError); err != nil && !cancel {
+		l.errors++
+	}
+	l.broadcast()
+}
+
+func (l *concurrencyLimiter) broadcast() {
+	close(l.wake)
+	l.wake = make(chan struct{})
+}
+
+const adaptInterval = 5 * time.Second
+
+// adapt changes the concurrency limit every adaptInterval until ctx is done.
+// The limit is halved whenever downloads fail, and otherwise moved one step
+// in the direction that increased the throughput measured by bw.
+func (l *concurrencyLimiter) adapt(ctx context.Context, bw *rateLimiter) {
+	l.mu.Lock()
+	l.limit = (l.max + 1) / 2
+	l.mu.Unlock()
+
+	ticker := time.NewTicker(adaptInterval)
+	defer ticker.Stop()
+
+	var (
+		prevBytes      = bw.total()
+		prevThroughput float64
+		step           = 1
+	)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		bytes := bw.total()
+		throughput := float64(bytes-prevBytes) / adaptInterval.Seconds()
+		prevBytes = bytes
+
+		l.mu.Lock()
+		switch {
+		case l.errors > 0:
+			l.limit = (l.limit + 1) / 2
+			step = 1
+		case throughput < prevThroughput*0.9:
+			step = -step
+			l.limit += step
+		case throughput > prevThroughput*1.05:
+			l.limit += step
+		}
+		if l.limit < 1 {
+			l.limit = 1
+		} else if l.limit > l.max {
+			l.limit = l.max
+		}
+		logrus.Debugf("throughput %.0f B/s with %d errors, concurrency set to %d",
+			throughput, l.errors, l.limit)
+		l.errors = 0
+		l.broadcast()
+		l.mu.Unlock()
+
+		prevThroughput = throughput
+	}
+}
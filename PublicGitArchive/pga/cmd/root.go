@@ -17,6 +17,18 @@ var RootCmd = &cobra.Command{
 For more info, check http://pga.sourced.tech/`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
 		cmd.SilenceUsage = true
+		// The version set in the configuration does not override the pinned
+		// versions, unlike --pga-version.
+		pgaVersionSet = cmd.Flags().Changed("pga-version")
+		var err error
+		pgaConfig, err = loadConfig()
+		if err != nil {
+			return err
+		}
+		if err := pgaConfig.apply(cmd); err != nil {
+			return err
+		}
+		// verbose may be set by the configuration too.
 		v, err := cmd.Flags().GetBool("verbose")
 		if err != nil {
 			return err
@@ -24,14 +36,25 @@ For more info, check http://pga.sourced.tech/`,
 		if v {
 			logrus.SetLevel(logrus.DebugLevel)
 		}
+
 		pv, err := cmd.Flags().GetString("pga-version")
 		if err != nil {
 			return err
 		}
 		pgaVersion = pv
-		indexName = pv + ".index.csv.gz"
+		requestedVersion = pv
+		indexName = pv + indexSuffix
 
-		return nil
+		format, err := cmd.Flags().GetString("events")
+		if err != nil {
+			return err
+		}
+		path, err := cmd.Flags().GetString("events-file")
+		if err != nil {
+			return err
+		}
+		events, err = openEventLog(cmd.Name(), format, path)
+		return err
 	},
 }
 
@@ -46,9 +69,22 @@ func Execute() {
 var (
 	indexName  string
 	pgaVersion string
+	mirrorURL  string
+
+	// requestedVersion and pgaVersionSet hold the value of --pga-version and
+	// whether it was explicitly set, pgaVersion is the resolved version.
+	requestedVersion string
+	pgaVersionSet    bool
+
+	// pgaConfig is the user configuration merged with the project one.
+	pgaConfig *projectConfig
 )
 
 func init() {
 	RootCmd.PersistentFlags().BoolP("verbose", "v", false, "log more information")
-	RootCmd.PersistentFlags().StringVar(&pgaVersion, "pga-version", "latest", "pga version to be used")
+	RootCmd.PersistentFlags().String("profile", "", "profile of the configuration file to take the flag defaults from")
+	RootCmd.PersistentFlags().StringVar(&pgaVersion, "pga-version", latestVersion, "pga version to be used")
+	RootCmd.PersistentFlags().StringVar(&mirrorURL, "mirror", rootURL, "server or mirror to get the indexes and files from")
+	RootCmd.PersistentFlags().String("events", "", "write machine readable events of the progress, only jsonl is supported")
+	RootCmd.PersistentFlags().String("events-file", "", "file the --events are appended to instead of the standard error")
 }
@@ -0,0 +1,693 @@
+package cmd
+
+import (
+	"bytes"
+	lru "container/list"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga/filters"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga/sivarepo"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+const defaultLogLimit = 50
+
+// shutdownTimeout is how long the requests in progress are waited for when
+// the server is stopped.
+const shutdownTimeout = 5 * time.Second
+
+// maxOpenArchives is the number of siva files kept open, each with its own
+// object cache. The least recently used are closed past it.
+const maxOpenArchives = 16
+
+// apiError is an error with the HTTP status code to answer with.
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string { return e.err.Error() }
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+func notFound(format string, args ...interface{}) error {
+	return &apiError{http.StatusNotFound, fmt.Errorf(format, args...)}
+}
+
+// sortKeys are the fields the repositories of the index can be sorted by,
+// named as in their JSON representation.
+var sortKeys = map[string]func(r pga.Repository) int64{
+	"size":          func(r pga.Repository) int64 { return r.GetSize() },
+	"fileCount":     sivaField(func(r *pga.SivaRepository) int64 { return r.Files }),
+	"commitsCount":  sivaField(func(r *pga.SivaRepository) int64 { return r.Commits }),
+	"branchesCount": sivaField(func(r *pga.SivaRepository) int64 { return r.Branches }),
+	"forkCount":     sivaField(func(r *pga.SivaRepository) int64 { return r.Forks }),
+	"stars":         sivaField(func(r *pga.SivaRepository) int64 { return r.Stars }),
+}
+
+func sivaField(f func(r *pga.SivaRepository) int64) func(r pga.Repository) int64 {
+	return func(r pga.Repository) int64 {
+		if sr, ok := r.(*pga.SivaRepository); ok {
+			return f(sr)
+		}
+		return 0
+	}
+}
+
+// server answers the API requests. The indexes are read once, the first time
+// they are queried, and kept in memory, while only the siva files used last
+// are kept open.
+type server struct {
+	ctx     context.Context
+	sivaDir string
+
+	mu       sync.Mutex
+	indexes  map[string]*datasetIndex
+	files    map[string]string
+	archives map[string]*lru.Element
+	// recent holds the *sivaArchive open, the most recently used first.
+	recent *lru.List
+}
+
+// datasetIndex holds the repositories of the index of a dataset once loaded.
+// Its own lock lets the other datasets be queried while it is loaded.
+type datasetIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	repos  []pga.Repository
+}
+
+// sivaArchive is an opened siva file. Its lock serializes the reads of the
+// same siva file. It is closed once evicted and no request uses it.
+type sivaArchive struct {
+	fileName string
+	mu       sync.Mutex
+	modTime  time.Time
+	archive  *sivarepo.Archive
+
+	// users and evicted are guarded by the lock of the server.
+	users   int
+	evicted bool
+}
+
+func newServer(ctx context.Context, sivaDir string) *server {
+	return &server{
+		ctx:      ctx,
+		sivaDir:  sivaDir,
+		indexes:  map[string]*datasetIndex{},
+		files:    map[string]string{},
+		archives: map[string]*lru.Element{},
+		recent:   lru.New(),
+	}
+}
+
+func (s *server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	logrus.Debugf("%s %s", req.Method, req.URL)
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		writeError(w, &apiError{http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", req.Method)})
+		return
+	}
+	parts := strings.Split(strings.Trim(req.URL.Path, "/"), "/")
+	if len(parts) < 2 || parts[0] != "api" {
+		writeError(w, notFound("%s not found", req.URL.Path))
+		return
+	}
+	var err error
+	switch {
+	case len(parts) == 2 && parts[1] == "datasets":
+		err = s.datasets(w)
+	case len(parts) == 4 && parts[1] == "siva":
+		err = s.siva(w, req, parts[2], parts[3])
+	case len(parts) == 3 && parts[2] == "repositories":
+		err = s.repositories(w, req, parts[1])
+	case len(parts) == 3 && parts[2] == "repository":
+		err = s.repository(w, req, parts[1])
+	default:
+		err = notFound("%s not found", req.URL.Path)
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// responseWriter writes a response once the siva file is not read anymore.
+type responseWriter func(w http.ResponseWriter) error
+
+// siva answers the requests about a siva file.
+func (s *server) siva(w http.ResponseWriter, req *http.Request, name, resource string) error {
+	var handler func(req *http.Request, name string, archive *sivarepo.Archive) (responseWriter, error)
+	switch resource {
+	case "repositories":
+		handler = s.sivaRepositories
+	case "tree":
+		handler = s.tree
+	case "blob":
+		handler = s.blob
+	case "log":
+		handler = s.log
+	default:
+		return notFound("%s not found", req.URL.Path)
+	}
+	var write responseWriter
+	err := s.withArchive(name, func(archive *sivarepo.Archive) error {
+		var err error
+		write, err = handler(req, name, archive)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return write(w)
+}
+
+// jsonResponse writes v as JSON.
+func jsonResponse(v interface{}) responseWriter {
+	return func(w http.ResponseWriter) error { return writeJSON(w, v) }
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*apiError); ok {
+		status = e.status
+	} else {
+		logrus.Errorf("%v", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
+
+func (s *server) datasets(w http.ResponseWriter) error {
+	names := make([]string, 0, len(pga.Datasets))
+	for _, dataset := range pga.Datasets {
+		names = append(names, dataset.Name())
+	}
+	sort.Strings(names)
+	return writeJSON(w, names)
+}
+
+// index returns the repositories in the index of a dataset, reading it the
+// first time.
+func (s *server) index(datasetName string) ([]pga.Repository, error) {
+	dataset, err := datasetByName(datasetName)
+	if err != nil {
+		return nil, &apiError{http.StatusNotFound, err}
+	}
+	s.mu.Lock()
+	index, ok := s.indexes[dataset.Name()]
+	if !ok {
+		index = &datasetIndex{}
+		s.indexes[dataset.Name()] = index
+	}
+	s.mu.Unlock()
+
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if index.loaded {
+		return index.repos, nil
+	}
+	version := datasetVersion(s.ctx, dataset.Name())
+	f, err := openIndex(s.ctx, dataset.Name(), version+indexSuffix)
+	if err != nil {
+		return nil, fmt.Errorf("could not open index file: %v", err)
+	}
+	defer f.Close()
+	var repos []pga.Repository
+	err = pga.ForEachRepository(s.ctx, csv.NewReader(f), dataset, func(pga.Repository) bool { return true },
+		func(r pga.Repository) error {
+			repos = append(repos, r)
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+	index.repos, index.loaded = repos, true
+	return repos, nil
+}
+
+// queryInt returns an integer query parameter, or def if it is not set.
+func queryInt(req *http.Request, name string, def int) (int, error) {
+	v := req.URL.Query().Get(name)
+	if v == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, badRequest("invalid %s %q", name, v)
+	}
+	return n, nil
+}
+
+// page returns the offset and limit query parameters, clamped to total.
+func page(req *http.Request, total, defaultLimit int) (offset, limit int, err error) {
+	if offset, err = queryInt(req, "offset", 0); err != nil {
+		return 0, 0, err
+	}
+	if limit, err = queryInt(req, "limit", defaultLimit); err != nil {
+		return 0, 0, err
+	}
+	if offset > total {
+		offset = total
+	}
+	return offset, limit, nil
+}
+
+// queryFilter builds the filter of the lang and url query parameters, like
+// the --lang and --url flags.
+func queryFilter(req *http.Request) (pga.Filter, error) {
+	var fs []pga.Filter
+	for _, langs := range req.URL.Query()["lang"] {
+		for _, lang := range strings.Split(langs, ",") {
+			fs = append(fs, filters.HasLanguage(lang))
+		}
+	}
+	f, err := filters.URLRegexp(req.URL.Query().Get("url"))
+	if err != nil {
+		return nil, badRequest("invalid regular expression in url: %v", err)
+	}
+	fs = append(fs, f)
+	return filters.And(fs...), nil
+}
+
+func (s *server) repositories(w http.ResponseWriter, req *http.Request, datasetName string) error {
+	filter, err := queryFilter(req)
+	if err != nil {
+		return err
+	}
+	index, err := s.index(datasetName)
+	if err != nil {
+		return err
+	}
+	var result []pga.Repository
+	for _, r := range index {
+		if filter(r) {
+			result = append(result, r)
+		}
+	}
+
+	q := req.URL.Query()
+	desc := false
+	switch q.Get("order") {
+	case "", "asc":
+	case "desc":
+		desc = true
+	default:
+		return badRequest("unknown order %q (choose from asc, desc)", q.Get("order"))
+	}
+	if key := q.Get("sort"); key == "url" {
+		sort.SliceStable(result, func(i, j int) bool {
+			a, b := result[i].GetURL(), result[j].GetURL()
+			if desc {
+				return a > b
+			}
+			return a < b
+		})
+	} else if key != "" {
+		field, ok := sortKeys[key]
+		if !ok {
+			return badRequest("unknown sort field %q", key)
+		}
+		sort.SliceStable(result, func(i, j int) bool {
+			a, b := field(result[i]), field(result[j])
+			if desc {
+				return a > b
+			}
+			return a < b
+		})
+	}
+
+	offset, limit, err := page(req, len(result), 100)
+	if err != nil {
+		return err
+	}
+	end := offset + limit
+	if end > len(result) {
+		end = len(result)
+	}
+	return writeJSON(w, map[string]interface{}{
+		"total":        len(result),
+		"offset":       offset,
+		"limit":        limit,
+		"repositories": append([]pga.Repository{}, result[offset:end]...),
+	})
+}
+
+func (s *server) repository(w http.ResponseWriter, req *http.Request, datasetName string) error {
+	url := req.URL.Query().Get("url")
+	if url == "" {
+		return badRequest("url is required")
+	}
+	index, err := s.index(datasetName)
+	if err != nil {
+		return err
+	}
+	for _, r := range index {
+		if r.GetURL() == url {
+			return writeJSON(w, r)
+		}
+	}
+	return notFound("repository %s not found in %s", url, datasetName)
+}
+
+// sivaFile returns the path of a siva file under the siva directory, looking
+// for it again if it was not there the last time.
+func (s *server) sivaFile(name string) (string, error) {
+	if name != filepath.Base(name) || !strings.HasSuffix(name, ".siva") {
+		return "", badRequest("invalid siva file name %q", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.files[name]; ok {
+		if _, err := os.Stat(p); err == nil {
+			return p, nil
+		}
+	}
+	files, err := sivaFiles(s.sivaDir)
+	if err != nil {
+		return "", err
+	}
+	s.files = map[string]string{}
+	for _, f := range files {
+		s.files[filepath.Base(f)] = f
+	}
+	if p, ok := s.files[name]; ok {
+		return p, nil
+	}
+	return "", notFound("siva file %s not found", name)
+}
+
+// acquire returns the siva file to use, making it the most recently used and
+// evicting the least recently used past maxOpenArchives.
+func (s *server) acquire(fileName string) *sivaArchive {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var a *sivaArchive
+	if e, ok := s.archives[fileName]; ok {
+		s.recent.MoveToFront(e)
+		a = e.Value.(*sivaArchive)
+	} else {
+		a = &sivaArchive{fileName: fileName}
+		s.archives[fileName] = s.recent.PushFront(a)
+	}
+	for s.recent.Len() > maxOpenArchives {
+		s.evict(s.recent.Back())
+	}
+	a.users++
+	return a
+}
+
+// release ends the use of a siva file, closing it if it was evicted.
+func (s *server) release(a *sivaArchive) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	a.users--
+	if a.evicted && a.users == 0 {
+		a.close()
+	}
+}
+
+// evict removes a siva file from the open ones, closing it unless a request
+// still uses it. s.mu must be held.
+func (s *server) evict(e *lru.Element) {
+	a := s.recent.Remove(e).(*sivaArchive)
+	delete(s.archives, a.fileName)
+	a.evicted = true
+	if a.users == 0 {
+		a.close()
+	}
+}
+
+// close closes the siva files, those in use once their requests end.
+func (s *server) close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.recent.Len() > 0 {
+		s.evict(s.recent.Front())
+	}
+}
+
+func (a *sivaArchive) close() {
+	if a.archive == nil {
+		return
+	}
+	if err := a.archive.Close(); err != nil {
+		logrus.Warnf("unable to close %s: %v", a.fileName, err)
+	}
+	a.archive = nil
+}
+
+// withArchive calls f with a siva file, opened the first time and again
+// whenever the file changes. The calls for the same siva file run one at a
+// time, so f must not write the response.
+func (s *server) withArchive(name string, f func(archive *sivarepo.Archive) error) error {
+	fileName, err := s.sivaFile(name)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return notFound("siva file %s not found", name)
+	}
+	a := s.acquire(fileName)
+	defer s.release(a)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.archive == nil || !a.modTime.Equal(info.ModTime()) {
+		a.close()
+		archive, err := loadArchive(fileName)
+		if err != nil {
+			return err
+		}
+		a.archive, a.modTime = archive, info.ModTime()
+	}
+	return f(a.archive)
+}
+
+func (s *server) sivaRepositories(req *http.Request, name string, archive *sivarepo.Archive) (responseWriter, error) {
+	infos, err := rootedRepositories(archive)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the repositories in %s", name)
+	}
+	return jsonResponse(infos), nil
+}
+
+// queryCommit returns the commit selected by the repo, ref and commit query
+// parameters, like the --repo, --ref and --commit flags.
+func queryCommit(archive *sivarepo.Archive, req *http.Request) (*dumpTarget, error) {
+	q := req.URL.Query()
+	uuid := ""
+	if idOrURL := q.Get("repo"); idOrURL != "" {
+		var err error
+		if uuid, err = resolveRepositoryID(archive, idOrURL); err != nil {
+			return nil, &apiError{http.StatusNotFound, err}
+		}
+	}
+	targets, err := selectTargets(archive.Rooted, uuid, q.Get("commit"), q.Get("ref"))
+	if err != nil {
+		return nil, &apiError{http.StatusNotFound, err}
+	}
+	target, err := onlyTarget(targets)
+	if err != nil {
+		return nil, &apiError{http.StatusBadRequest, err}
+	}
+	return target, nil
+}
+
+func (s *server) tree(req *http.Request, name string, archive *sivarepo.Archive) (responseWriter, error) {
+	repo := archive.Rooted
+	target, err := queryCommit(archive, req)
+	if err != nil {
+		return nil, err
+	}
+	commit := target.commit
+	recursive, _ := strconv.ParseBool(req.URL.Query().Get("recursive"))
+	entries := []*treeEntry{}
+	err = listTree(repo, commit, treePath(req.URL.Query().Get("path")), recursive, func(e *treeEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if errors.Cause(err) == errNotADirectory {
+		return nil, badRequest("%v", err)
+	} else if err == object.ErrDirectoryNotFound || errors.Cause(err) == object.ErrDirectoryNotFound {
+		return nil, notFound("%v", err)
+	} else if err != nil {
+		return nil, err
+	}
+	return jsonResponse(map[string]interface{}{"commit": commit.Hash.String(), "entries": entries}), nil
+}
+
+func (s *server) blob(req *http.Request, name string, archive *sivarepo.Archive) (responseWriter, error) {
+	repo := archive.Rooted
+	target, err := queryCommit(archive, req)
+	if err != nil {
+		return nil, err
+	}
+	commit := target.commit
+	p := treePath(req.URL.Query().Get("path"))
+	if p == "" {
+		return nil, badRequest("path is required")
+	}
+	reader, err := openFile(repo, commit, p)
+	switch cause := errors.Cause(err); {
+	case cause == errNotAFile:
+		return nil, badRequest("%v", err)
+	case cause == object.ErrFileNotFound || cause == object.ErrDirectoryNotFound || cause == object.ErrEntryNotFound:
+		return nil, notFound("%v", err)
+	case err != nil:
+		return nil, err
+	}
+	defer reader.Close()
+	// The blob is read before answering so that a slow client does not keep
+	// the siva file from the other requests.
+	var content bytes.Buffer
+	if _, err := io.Copy(&content, reader); err != nil {
+		return nil, errors.Wrapf(err, "unable to read %s from %s", p, name)
+	}
+	return func(w http.ResponseWriter) error {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Commit", commit.Hash.String())
+		if _, err := content.WriteTo(w); err != nil {
+			// The response has started, it can not be an error anymore.
+			logrus.Errorf("failed to send %s from %s: %v", p, name, err)
+		}
+		return nil
+	}, nil
+}
+
+func (s *server) log(req *http.Request, name string, archive *sivarepo.Archive) (responseWriter, error) {
+	repo := archive.Rooted
+	target, err := queryCommit(archive, req)
+	if err != nil {
+		return nil, err
+	}
+	commit := target.commit
+	offset, err := queryInt(req, "offset", 0)
+	if err != nil {
+		return nil, err
+	}
+	limit, err := queryInt(req, "limit", defaultLogLimit)
+	if err != nil {
+		return nil, err
+	}
+	iter, err := repo.Log(&git.LogOptions{From: commit.Hash})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the history of %s", commit.Hash.String())
+	}
+	// The key is the commit hash when no repository was selected.
+	repository := target.key
+	if repository == commit.Hash.String() {
+		repository = ""
+	}
+	records := []*commitRecord{}
+	i := 0
+	err = iter.ForEach(func(c *object.Commit) error {
+		if i++; i <= offset {
+			return nil
+		}
+		if len(records) == limit {
+			return storer.ErrStop
+		}
+		r, err := newCommitRecord(repository, c)
+		if err != nil {
+			return err
+		}
+		records = append(records, r)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jsonResponse(map[string]interface{}{
+		"commit":  commit.Hash.String(),
+		"offset":  offset,
+		"limit":   limit,
+		"commits": records,
+	}), nil
+}
+
+// serveCmd represents the serve command
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "serve the indexes and the downloaded siva files with a JSON API",
+	Long: `Serves a JSON REST API to query the indexes and browse the siva files under
+--siva-dir, as downloaded with pga get:
+
+  GET /api/datasets
+  GET /api/<dataset>/repositories?lang=&url=&sort=&order=asc|desc&offset=&limit=
+  GET /api/<dataset>/repository?url=
+  GET /api/siva/<file.siva>/repositories
+  GET /api/siva/<file.siva>/tree?repo=&ref=&commit=&path=&recursive=
+  GET /api/siva/<file.siva>/blob?repo=&ref=&commit=&path=
+  GET /api/siva/<file.siva>/log?repo=&ref=&commit=&offset=&limit=
+
+repo, ref and commit select the revision like the flags of pga siva, by
+default the HEAD of the only repository in the siva file. The repositories
+can be sorted by url or any of their numeric fields, e.g. size or stars.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		if flags.NArg() != 0 {
+			return fmt.Errorf("usage: pga serve [--address host:port] [--siva-dir directory]")
+		}
+		address, err := flags.GetString("address")
+		if err != nil {
+			return err
+		}
+		sivaDir, err := flags.GetString("siva-dir")
+		if err != nil {
+			return err
+		}
+		if info, err := os.Stat(sivaDir); err != nil {
+			return err
+		} else if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", sivaDir)
+		}
+		ctx := setupContext()
+		s := newServer(ctx, sivaDir)
+		defer s.close()
+		srv := &http.Server{Addr: address, Handler: s}
+		go func() {
+			<-ctx.Done()
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+			defer cancel()
+			_ = srv.Shutdown(shutdownCtx)
+		}()
+		logrus.Infof("serving on http://%s", address)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			return err
+		}
+		return nil
+	},
+}
+
+func init() {
+	RootCmd.AddCommand(serveCmd)
+	flags := serveCmd.Flags()
+	flags.StringP("address", "a", "localhost:8080", "address to listen on")
+	flags.String("siva-dir", ".", "directory with the downloaded siva files")
+}
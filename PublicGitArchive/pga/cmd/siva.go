@@ -2,235 +2,116 @@ package cmd
 
 import (
 	"fmt"
-	"io"
-	"os"
-	"path"
 	"path/filepath"
+	"runtime"
 	"sort"
 	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
-	sivafs "gopkg.in/src-d/go-billy-siva.v4"
-	"gopkg.in/src-d/go-billy.v4/memfs"
-	"gopkg.in/src-d/go-billy.v4/osfs"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga/sivarepo"
 	"gopkg.in/src-d/go-git.v4"
 	"gopkg.in/src-d/go-git.v4/plumbing"
-	"gopkg.in/src-d/go-git.v4/plumbing/cache"
-	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
-	"gopkg.in/src-d/go-git.v4/plumbing/object"
-	"gopkg.in/src-d/go-git.v4/storage/filesystem"
 	"gopkg.in/src-d/go-siva.v1/cmd/siva/impl"
 )
 
-var actions = map[string]func(flags *pflag.FlagSet) error{
+var actions = map[string]sivaAction{
 	"unpack": unpack,
 	"dump":   dump,
 	"list":   list,
+	"log":    logCommits,
+	"repos":  repos,
+	"export": export,
+	"cat":    cat,
+	"ls":     ls,
+	"grep":   grep,
+	"stats":  stats,
 }
 
-func unpack(flags *pflag.FlagSet) error {
-	var err error
-	cmd := &impl.CmdUnpack{Overwrite: true, IgnorePerms: true}
-	cmd.Args.File = flags.Arg(1)
-	cmd.Output.Path, err = flags.GetString("output")
-	if err != nil {
-		return err
-	}
-	cmd.Match, err = flags.GetString("match")
-	if err != nil {
-		return err
-	}
-	return cmd.Execute(nil)
-}
+// argActions are the actions which take an additional argument, a path
+// inside the repository or a regular expression.
+var argActions = map[string]bool{"cat": true, "ls": true, "grep": true}
 
-func dump(flags *pflag.FlagSet) error {
-	output, err := flags.GetString("output")
-	if err != nil {
-		return errors.Wrapf(err, "required command line argument: -o/--output")
-	}
-	repo, err := loadRepository(flags.Arg(1))
-	if err != nil {
-		return err
-	}
-	fmt.Print("Reading the references, this may take some time... ")
+// repositoryHeads returns the commits pointed by the HEAD of each repository,
+// by UUID. If uuid is not empty, only that repository is returned.
+func repositoryHeads(repo *git.Repository, uuid string) (map[string]plumbing.Hash, error) {
 	refs, err := repo.References()
-	fmt.Println("done.")
 	if err != nil {
-		return errors.Wrapf(err, "unable to list Git references in %s", flags.Arg(1))
+		return nil, errors.Wrap(err, "unable to list Git references")
 	}
-	commits := map[string]*object.Commit{}
+	heads := map[string]plumbing.Hash{}
 	err = refs.ForEach(func(ref *plumbing.Reference) error {
-		refname := ref.Name()
-		if strings.HasPrefix(refname.String(), "refs/heads/HEAD/") {
-			commit, err := repo.CommitObject(ref.Hash())
-			if err != nil {
-				return errors.Wrapf(err, "failed to load %s in %s", ref.Hash().String(), flags.Arg(1))
-			}
-			commits[string(refname[len("refs/heads/HEAD/"):])] = commit
+		name := ref.Name().String()
+		if !strings.HasPrefix(name, sivarepo.HeadPrefix) {
+			return nil
 		}
-		return nil
-	})
-	for key, commit := range commits {
-		err = dumpFiles(commit, filepath.Join(output, key))
-		if err != nil {
-			return err
+		id := name[len(sivarepo.HeadPrefix):]
+		if uuid == "" || id == uuid {
+			heads[id] = ref.Hash()
 		}
-	}
-	return nil
-}
-
-func list(flags *pflag.FlagSet) error {
-	repo, err := loadRepository(flags.Arg(1))
-	if err != nil {
-		return err
-	}
-	fmt.Print("Reading the references, this may take some time... ")
-	refs, err := repo.References()
-	fmt.Println("done.")
-	if err != nil {
-		return errors.Wrapf(err, "unable to list Git references in %s", flags.Arg(1))
-	}
-	commitIter, err := repo.CommitObjects()
-	if err != nil {
-		return err
-	}
-	var commits []*object.Commit
-	err = commitIter.ForEach(func(commit *object.Commit) error {
-		commits = append(commits, commit)
 		return nil
 	})
 	if err != nil {
-		return err
-	}
-	stdout := os.Stdout
-	_, err = fmt.Fprintln(stdout, "{\n\t\"commits\": {")
-	if err != nil {
-		return err
+		return nil, err
 	}
-	for i, c := range commits {
-		hashes := make([]string, 0, len(c.ParentHashes))
-		for _, h := range c.ParentHashes {
-			hashes = append(hashes, "\""+h.String()+"\"")
-		}
-		_, err = fmt.Fprintf(stdout, "\t\t\"%s\": [%s]", c.Hash.String(), strings.Join(hashes, ", "))
-		if err != nil {
-			return err
-		}
-		if i < len(commits)-1 {
-			_, err = fmt.Fprintln(stdout, ",")
-		} else {
-			_, err = fmt.Fprintln(stdout)
-		}
-		if err != nil {
-			return err
-		}
+	if uuid != "" && len(heads) == 0 {
+		return nil, fmt.Errorf("repository %s not found", uuid)
 	}
-	_, err = fmt.Fprintln(stdout, "\t},\n\t\"references\": {")
-	if err != nil {
-		return err
+	return heads, nil
+}
+
+// repositoryFlag returns the UUID of the repository selected with --repo, if any.
+func repositoryFlag(flags *pflag.FlagSet, archive *sivarepo.Archive) (string, error) {
+	idOrURL, err := flags.GetString("repo")
+	if err != nil || idOrURL == "" {
+		return "", err
 	}
-	var refObjs []*plumbing.Reference
-	_ = refs.ForEach(func(ref *plumbing.Reference) error {
-		if ref.Hash() != plumbing.ZeroHash {
-			refObjs = append(refObjs, ref)
-		}
-		return nil
-	})
-	for i, ref := range refObjs {
-		_, err = fmt.Fprintf(stdout, "\t\t\"%s\": \"%s\"",
-			strings.Replace(ref.Name().String(), "\"", "\\\"", -1), ref.Hash().String())
-		if err != nil {
-			return err
-		}
-		if i < len(refObjs)-1 {
-			_, err = fmt.Fprintln(stdout, ",")
-		} else {
-			_, err = fmt.Fprintln(stdout)
-		}
-		if err != nil {
-			return err
-		}
+	return resolveRepositoryID(archive, idOrURL)
+}
+
+func sortedKeys(heads map[string]plumbing.Hash) []string {
+	keys := make([]string, 0, len(heads))
+	for k := range heads {
+		keys = append(keys, k)
 	}
-	_, err = fmt.Fprintln(stdout, "\t}\n}")
-	return err
+	sort.Strings(keys)
+	return keys
 }
 
-func loadRepository(fileName string) (*git.Repository, error) {
-	localFs := osfs.New(filepath.Dir(fileName))
-	tmpFs := memfs.New()
-	basePath := filepath.Base(fileName)
-	fs, err := sivafs.NewFilesystem(localFs, basePath, tmpFs)
+func unpack(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	var err error
+	cmd := &impl.CmdUnpack{Overwrite: true, IgnorePerms: true}
+	cmd.Args.File = fileName
+	cmd.Output.Path, err = flags.GetString("output")
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to create a siva filesystem from %s", fileName)
+		return err
 	}
-	sivaStorage := filesystem.NewStorage(fs, cache.NewObjectLRUDefault())
-	if sivaStorage == nil {
-		return nil, fmt.Errorf("unable to create a new storage backend from %s", fileName)
+	if out.batch() {
+		cmd.Output.Path = filepath.Join(cmd.Output.Path, strings.TrimSuffix(filepath.Base(fileName), ".siva"))
 	}
-	repo, err := git.Open(sivaStorage, tmpFs)
+	cmd.Match, err = flags.GetString("match")
 	if err != nil {
-		return nil, errors.Wrapf(err, "unable to open the Git repository from %s", fileName)
+		return err
 	}
-	return repo, nil
+	return cmd.Execute(nil)
 }
 
-func dumpFiles(commit *object.Commit, destDir string) error {
-	tree, err := commit.Tree()
-	if err != nil {
-		return errors.Wrapf(err, "could not read the tree from %s", commit.Hash.String())
-	}
-	err = tree.Files().ForEach(func(file *object.File) (res error) {
-		fmt.Println(path.Join(filepath.Base(destDir), file.Name))
-		destPath := filepath.Join(destDir, file.Name)
-		switch file.Mode {
-		case filemode.Dir:
-			return os.MkdirAll(destPath, 0777)
-		case filemode.Regular:
-			baseDir := filepath.Dir(destPath)
-			err = os.MkdirAll(baseDir, 0777)
-			if err != nil {
-				return errors.Wrapf(err, "failed to create directory %s", baseDir)
-			}
-			writer, err := os.Create(destPath)
-			if err != nil {
-				return errors.Wrapf(err, "failed to create %s", destPath)
-			}
-			defer func() {
-				err = writer.Close()
-				if err != nil {
-					res = errors.Wrapf(err, "failed to close %s", destPath)
-				}
-			}()
-			reader, err := file.Reader()
-			if err != nil {
-				return errors.Wrapf(err, "failed to read %s %s", file.Name, file.Hash.String())
-			}
-			defer reader.Close()
-			written, err := io.Copy(writer, reader)
-			if err != nil {
-				return errors.Wrapf(err, "failed to write %s - only %d bytes were written from %s",
-					destPath, written, file.Hash.String())
-			}
-			return nil
-		default:
-			return nil
-		}
-	})
-	return err
+// loadArchive opens a siva file.
+func loadArchive(fileName string) (*sivarepo.Archive, error) {
+	return sivarepo.OpenFile(fileName)
 }
 
 // sivaCmd represents the set of commands to work with the siva files: extract revisions, list, dump raw contents.
 var sivaCmd = &cobra.Command{
 	Use:   "siva",
 	Short: "work with siva files",
-	Long:  `Unpack, dump specific or HEAD revisions, list revisions.`,
+	Long:  `Unpack, dump the files of specific or HEAD revisions, list revisions, export the commit history, list and export repositories, print single files and directories, grep, compute index statistics. Every action accepts a siva file, a directory of siva files or a glob.`,
 	RunE: func(cmd *cobra.Command, args []string) (err error) {
-		if cmd.Flags().NArg() != 2 {
-			return fmt.Errorf("usage: pga siva <action> /path/to/siva")
-		}
 		action := cmd.Flags().Arg(0)
+		if n := cmd.Flags().NArg(); n != 2 && !(n == 3 && argActions[action]) {
+			return fmt.Errorf("usage: pga siva <action> /path/to/siva/directory/or/glob [argument]")
+		}
 		actionFunc, exists := actions[action]
 		if !exists {
 			knownActions := make([]string, 0, len(actions))
@@ -241,7 +122,7 @@ var sivaCmd = &cobra.Command{
 			return fmt.Errorf("unknown action: %s (choose from %s)",
 				action, strings.Join(knownActions, ", "))
 		}
-		return actionFunc(cmd.Flags())
+		return runSivaAction(cmd.Flags(), action, actionFunc)
 	},
 }
 
@@ -250,5 +131,16 @@ func init() {
 	flags := sivaCmd.Flags()
 	addFilterFlags(flags)
 	flags.StringP("match", "m", ".*", "only extract files matching the given regexp")
-	flags.StringP("output", "o", ".", "output directory")
+	flags.StringP("output", "o", ".", "output directory, or archive file for dump with tar or zip")
+	flags.StringP("format", "f", "", "output format, depends on the action")
+	flags.String("repo", "", "UUID or remote URL of the only repository to consider")
+	flags.String("ref", "", "dump this reference of each repository instead of HEAD, e.g. master or v1.0")
+	flags.String("commit", "", "dump this commit or revision instead of HEAD")
+	flags.StringSlice("path", nil, "only dump files matching these globs, e.g. *.go or src/*")
+	flags.StringSlice("file-lang", nil, "only dump or grep the files of these languages, e.g. go,python")
+	flags.IntP("jobs", "j", runtime.NumCPU(), "number of siva files processed in parallel")
+	flags.Bool("index", false, "only process the siva files holding the repositories selected in the index by --lang and --url")
+	flags.Bool("binary", false, "grep binary files too")
+	flags.Bool("recursive", false, "list the subdirectories with ls")
+	flags.String("symlinks", "link", "how to dump symbolic links: link, file or skip")
 }
@@ -0,0 +1,289 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+)
+
+// sivaAction processes a single siva file, writing its results to out.
+type sivaAction func(flags *pflag.FlagSet, fileName string, out *sivaOutput) error
+
+// sivaOutput is where the actions write their results. When several siva
+// files are processed in parallel the output of each one is buffered, so that
+// it is not interleaved with the others, and headers are written only once.
+type sivaOutput struct {
+	io.Writer
+	shared *sharedOutput
+}
+
+type sharedOutput struct {
+	mu     sync.Mutex
+	w      io.Writer
+	header sync.Once
+}
+
+// batch returns whether several siva files are being processed.
+func (o *sivaOutput) batch() bool {
+	return o.shared != nil
+}
+
+// header writes the header of the output, only once when processing several
+// siva files.
+func (o *sivaOutput) header(write func(w io.Writer) error) error {
+	if o.shared == nil {
+		return write(o.Writer)
+	}
+	var err error
+	o.shared.header.Do(func() {
+		o.shared.mu.Lock()
+		defer o.shared.mu.Unlock()
+		err = write(o.shared.w)
+	})
+	return err
+}
+
+// csvHeader writes the header of a CSV output, only once when processing
+// several siva files.
+func (o *sivaOutput) csvHeader(header []string) error {
+	return o.header(func(w io.Writer) error {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(header); err != nil {
+			return err
+		}
+		cw.Flush()
+		return cw.Error()
+	})
+}
+
+// singleFileFormats are the formats of each action whose output can not be
+// combined for several siva files.
+var singleFileFormats = map[string][]string{
+	"log":  {"parquet"},
+	"dump": {"tar", "zip"},
+}
+
+// errBatchFormat is returned by the actions whose output can not be combined
+// for several siva files.
+func errBatchFormat(format string) error {
+	return fmt.Errorf("--format %s can not be used with several siva files", format)
+}
+
+// isGlob returns whether the path contains any of the special characters
+// of filepath.Match.
+func isGlob(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
+
+// sivaFiles returns the siva files in root, which can be a siva file or a
+// directory searched recursively.
+func sivaFiles(root string) ([]string, error) {
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{root}, nil
+	}
+	var files []string
+	err = filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && strings.HasSuffix(p, ".siva") {
+			files = append(files, p)
+		}
+		return nil
+	})
+	return files, err
+}
+
+// sivaInputs returns the siva files selected on the command line: a single
+// file, all the siva files in a directory or matching a glob, optionally
+// restricted with --index to those selected by the index filters. batch is
+// false if a single file was given.
+func sivaInputs(flags *pflag.FlagSet) (files []string, batch bool, err error) {
+	arg := flags.Arg(1)
+	if isGlob(arg) {
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, m := range matches {
+			if info, err := os.Stat(m); err == nil && !info.IsDir() {
+				files = append(files, m)
+			}
+		}
+		batch = true
+	} else {
+		info, err := os.Stat(arg)
+		if err != nil {
+			return nil, false, err
+		}
+		batch = info.IsDir()
+		if files, err = sivaFiles(arg); err != nil {
+			return nil, false, err
+		}
+	}
+
+	index, err := flags.GetBool("index")
+	if err != nil {
+		return nil, false, err
+	}
+	dataset, err := datasetByName("siva")
+	if err != nil {
+		return nil, false, err
+	}
+	if err := checkDatasetFilterFlags(flags, dataset); err != nil {
+		return nil, false, err
+	}
+	if !index {
+		for _, name := range []string{"lang", "url"} {
+			if f := flags.Lookup(name); f != nil && isSet(f) {
+				return nil, false, fmt.Errorf("--%s selects siva files in the index, it requires --index", name)
+			}
+		}
+		return files, batch, nil
+	}
+	selected, err := indexedSivaFiles(flags)
+	if err != nil {
+		return nil, false, err
+	}
+	var result []string
+	for _, f := range files {
+		if _, ok := selected[filepath.Base(f)]; ok {
+			result = append(result, f)
+		}
+	}
+	if missing := len(selected) - len(result); missing > 0 {
+		logrus.Warnf("%d of the %d siva files selected in the index were not found in %s",
+			missing, len(selected), arg)
+	}
+	return result, true, nil
+}
+
+// indexedSivaFiles returns the names of the siva files holding the
+// repositories selected by the filter flags in the index.
+func indexedSivaFiles(flags *pflag.FlagSet) (map[string]struct{}, error) {
+	dataset, err := datasetByName("siva")
+	if err != nil {
+		return nil, err
+	}
+	ctx := setupContext()
+	resolveVersion(ctx, dataset.Name())
+	f, err := getIndex(ctx, dataset.Name())
+	if err != nil {
+		return nil, fmt.Errorf("could not open index file: %v", err)
+	}
+	defer f.Close()
+	filter, err := filterFromFlags(flags)
+	if err != nil {
+		return nil, err
+	}
+	filenames := map[string]struct{}{}
+	err = pga.ForEachRepository(ctx, csv.NewReader(f), dataset, filter, func(r pga.Repository) error {
+		for _, filename := range r.GetFilenames() {
+			filenames[filename] = struct{}{}
+		}
+		return nil
+	})
+	return filenames, err
+}
+
+// runSivaAction runs the action on every siva file selected on the command
+// line, --jobs of them in parallel, and reports the files which failed.
+func runSivaAction(flags *pflag.FlagSet, name string, action sivaAction) error {
+	files, batch, err := sivaInputs(flags)
+	if err != nil {
+		return errors.Wrapf(err, "unable to select the siva files in %s", flags.Arg(1))
+	}
+	if !batch {
+		return action(flags, files[0], &sivaOutput{Writer: os.Stdout})
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no siva files found in %s", flags.Arg(1))
+	}
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	for _, f := range singleFileFormats[name] {
+		if f == format {
+			return errBatchFormat(format)
+		}
+	}
+	jobs, err := flags.GetInt("jobs")
+	if err != nil {
+		return err
+	}
+	if jobs < 1 {
+		return fmt.Errorf("--jobs must be at least 1")
+	}
+
+	ctx := setupContext()
+	queue := make(chan string)
+	go func() {
+		defer close(queue)
+		for _, f := range files {
+			select {
+			case queue <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	shared := &sharedOutput{w: os.Stdout}
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+	)
+	for i := 0; i < jobs; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range queue {
+				out := &sivaOutput{Writer: os.Stdout, shared: shared}
+				var buf *bytes.Buffer
+				if jobs > 1 {
+					buf = new(bytes.Buffer)
+					out.Writer = buf
+				}
+				err := action(flags, f, out)
+				if buf != nil {
+					shared.mu.Lock()
+					if _, werr := buf.WriteTo(shared.w); err == nil {
+						err = werr
+					}
+					shared.mu.Unlock()
+				}
+				if err != nil {
+					logrus.Errorf("%s: %v", f, err)
+					mu.Lock()
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return &pga.CommandCanceledError{}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d siva files failed", failed, len(files))
+	}
+	return nil
+}
@@ -0,0 +1,231 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga/sivarepo"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// singleTarget returns the only revision selected with --commit, --ref and
+// --repo, failing if the siva file holds several repositories and none was
+// chosen.
+func singleTarget(archive *sivarepo.Archive, flags *pflag.FlagSet) (*dumpTarget, error) {
+	targets, err := dumpTargets(archive, flags)
+	if err != nil {
+		return nil, err
+	}
+	return onlyTarget(targets)
+}
+
+func onlyTarget(targets []dumpTarget) (*dumpTarget, error) {
+	switch len(targets) {
+	case 0:
+		return nil, fmt.Errorf("no revision found")
+	case 1:
+		return &targets[0], nil
+	default:
+		keys := make([]string, 0, len(targets))
+		for _, t := range targets {
+			keys = append(keys, t.key)
+		}
+		return nil, fmt.Errorf("several repositories found, choose one with --repo or --commit: %s",
+			strings.Join(keys, ", "))
+	}
+}
+
+// treePath cleans the path given on the command line, the root is "".
+func treePath(p string) string {
+	return strings.Trim(path.Clean("/"+p), "/")
+}
+
+// cat writes the contents of a single file at the selected revision.
+func cat(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	if flags.NArg() != 3 {
+		return fmt.Errorf("usage: pga siva cat /path/to/siva path")
+	}
+	name := treePath(flags.Arg(2))
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	repo := archive.Rooted
+	target, err := singleTarget(archive, flags)
+	if err != nil {
+		return errors.Wrapf(err, "unable to select the revision in %s", fileName)
+	}
+	reader, err := openFile(repo, target.commit, name)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	_, err = io.Copy(out, reader)
+	return err
+}
+
+// errNotAFile is returned by openFile for directories and submodules.
+var errNotAFile = errors.New("not a file")
+
+// openFile returns the contents of a file of the commit.
+func openFile(repo *git.Repository, commit *object.Commit, name string) (io.ReadCloser, error) {
+	tree, err := commit.Tree()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read the tree from %s", commit.Hash.String())
+	}
+	entry, err := tree.FindEntry(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "%s not found in %s", name, commit.Hash.String())
+	}
+	if entry.Mode == filemode.Dir || entry.Mode == filemode.Submodule {
+		return nil, errors.Wrapf(errNotAFile, "%s", name)
+	}
+	blob, err := repo.BlobObject(entry.Hash)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s %s", name, entry.Hash.String())
+	}
+	reader, err := blob.Reader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s %s", name, entry.Hash.String())
+	}
+	return reader, nil
+}
+
+// treeEntry is a single line of the output of ls.
+type treeEntry struct {
+	Mode string `json:"mode"`
+	Type string `json:"type"`
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+	Path string `json:"path"`
+}
+
+// ls lists the entries of a single directory at the selected revision, or of
+// all its subdirectories with --recursive.
+func ls(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	if flags.NArg() > 3 {
+		return fmt.Errorf("usage: pga siva ls /path/to/siva [path]")
+	}
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	recursive, err := flags.GetBool("recursive")
+	if err != nil {
+		return err
+	}
+	name := treePath(flags.Arg(2))
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	repo := archive.Rooted
+	target, err := singleTarget(archive, flags)
+	if err != nil {
+		return errors.Wrapf(err, "unable to select the revision in %s", fileName)
+	}
+
+	var write func(e *treeEntry) error
+	var flush func() error
+	switch format {
+	case "":
+		// Same output as git ls-tree --long.
+		w := bufio.NewWriter(out)
+		if out.batch() {
+			fmt.Fprintf(w, "%s:\n", fileName)
+		}
+		write = func(e *treeEntry) error {
+			size := "-"
+			if e.Size >= 0 {
+				size = strconv.FormatInt(e.Size, 10)
+			}
+			_, err := fmt.Fprintf(w, "%s %s %s %7s\t%s\n", e.Mode, e.Type, e.Hash, size, e.Path)
+			return err
+		}
+		flush = w.Flush
+	case "json":
+		e := json.NewEncoder(out)
+		write = func(entry *treeEntry) error { return e.Encode(entry) }
+		flush = func() error { return nil }
+	default:
+		return fmt.Errorf("unknown format in --format %q (choose from json)", format)
+	}
+
+	if err := listTree(repo, target.commit, name, recursive, write); err != nil {
+		return err
+	}
+	return flush()
+}
+
+// errNotADirectory is returned by listTree for files.
+var errNotADirectory = errors.New("not a directory")
+
+// listTree calls f for each entry of a directory of the commit, or of all its
+// subdirectories if recursive is set.
+func listTree(repo *git.Repository, commit *object.Commit, name string, recursive bool,
+	f func(e *treeEntry) error) error {
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return errors.Wrapf(err, "could not read the tree from %s", commit.Hash.String())
+	}
+	if name != "" {
+		if tree, err = tree.Tree(name); err == object.ErrDirectoryNotFound {
+			return errors.Wrapf(errNotADirectory, "%s in %s", name, commit.Hash.String())
+		} else if err != nil {
+			return errors.Wrapf(err, "could not read %s", name)
+		}
+	}
+	return walkTree(repo, tree, name, recursive, func(e object.TreeEntry, p string) error {
+		entry := &treeEntry{Mode: fmt.Sprintf("%06o", uint32(e.Mode)), Hash: e.Hash.String(), Size: -1, Path: p}
+		switch e.Mode {
+		case filemode.Dir:
+			entry.Type = "tree"
+		case filemode.Submodule:
+			entry.Type = "commit"
+		default:
+			entry.Type = "blob"
+			size, err := repo.Storer.EncodedObjectSize(e.Hash)
+			if err != nil {
+				return errors.Wrapf(err, "failed to read %s %s", p, e.Hash.String())
+			}
+			entry.Size = size
+		}
+		return f(entry)
+	})
+}
+
+// walkTree calls f for each entry of the tree, whose path is prefix. If
+// recursive is set the subtrees are walked instead of being passed to f.
+func walkTree(repo *git.Repository, tree *object.Tree, prefix string, recursive bool,
+	f func(e object.TreeEntry, p string) error) error {
+
+	for _, e := range tree.Entries {
+		p := path.Join(prefix, e.Name)
+		if !recursive || e.Mode != filemode.Dir {
+			if err := f(e, p); err != nil {
+				return err
+			}
+			continue
+		}
+		subtree, err := repo.TreeObject(e.Hash)
+		if err != nil {
+			return errors.Wrapf(err, "could not read %s", p)
+		}
+		if err := walkTree(repo, subtree, p, recursive, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,448 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	enry "github.com/go-enry/go-enry/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga/sivarepo"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// dumpTarget is a commit to dump, key is the directory it is dumped to.
+type dumpTarget struct {
+	key    string
+	commit *object.Commit
+}
+
+// dumpTargets returns the commits selected with --commit, --ref and --repo,
+// by default the HEAD of every repository.
+func dumpTargets(archive *sivarepo.Archive, flags *pflag.FlagSet) ([]dumpTarget, error) {
+	uuid, err := repositoryFlag(flags, archive)
+	if err != nil {
+		return nil, err
+	}
+	rev, err := flags.GetString("commit")
+	if err != nil {
+		return nil, err
+	}
+	refName, err := flags.GetString("ref")
+	if err != nil {
+		return nil, err
+	}
+	return selectTargets(archive.Rooted, uuid, rev, refName)
+}
+
+// selectTargets returns the given commit, or the given reference of each
+// repository, or its HEAD. If uuid is not empty only that repository is
+// considered.
+func selectTargets(repo *git.Repository, uuid, rev, refName string) ([]dumpTarget, error) {
+	if rev != "" {
+		h, err := repo.ResolveRevision(plumbing.Revision(rev))
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to resolve %s", rev)
+		}
+		c, err := peelCommit(repo, *h)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to load commit %s", rev)
+		}
+		key := uuid
+		if key == "" {
+			key = c.Hash.String()
+		}
+		return []dumpTarget{{key: key, commit: c}}, nil
+	}
+
+	heads, err := repositoryHeads(repo, uuid)
+	if err != nil {
+		return nil, err
+	}
+	var targets []dumpTarget
+	for _, id := range sortedKeys(heads) {
+		h := heads[id]
+		if refName != "" {
+			ref, err := repositoryReference(repo, id, refName)
+			if err == plumbing.ErrReferenceNotFound && uuid == "" {
+				continue
+			} else if err != nil {
+				return nil, errors.Wrapf(err, "unable to find %s in %s", refName, id)
+			}
+			h = ref.Hash()
+		}
+		c, err := peelCommit(repo, h)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to load %s", h.String())
+		}
+		targets = append(targets, dumpTarget{key: id, commit: c})
+	}
+	return targets, nil
+}
+
+// repositoryReference returns the reference of a repository in a rooted
+// repository. The name can be complete, such as refs/heads/master, or short,
+// such as master or v1.0.
+func repositoryReference(repo *git.Repository, uuid, name string) (*plumbing.Reference, error) {
+	candidates := []string{name}
+	if !strings.HasPrefix(name, "refs/") {
+		candidates = []string{"refs/heads/" + name, "refs/tags/" + name}
+	}
+	for _, c := range candidates {
+		ref, err := repo.Reference(plumbing.ReferenceName(c+"/"+uuid), true)
+		if err == nil {
+			return ref, nil
+		} else if err != plumbing.ErrReferenceNotFound {
+			return nil, err
+		}
+	}
+	return nil, plumbing.ErrReferenceNotFound
+}
+
+// fileFilter decides which files of a tree are dumped.
+type fileFilter struct {
+	match *regexp.Regexp
+	globs []string
+	langs map[string]bool
+}
+
+func fileFilterFromFlags(flags *pflag.FlagSet) (*fileFilter, error) {
+	match, err := flags.GetString("match")
+	if err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(match)
+	if err != nil {
+		return nil, fmt.Errorf("invalid regular expression in --match: %v", err)
+	}
+	globs, err := flags.GetStringSlice("path")
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range globs {
+		if _, err := path.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob in --path %q: %v", g, err)
+		}
+	}
+	langs, err := flags.GetStringSlice("file-lang")
+	if err != nil {
+		return nil, err
+	}
+	f := &fileFilter{match: re, globs: globs}
+	if len(langs) > 0 {
+		f.langs = map[string]bool{}
+		for _, l := range langs {
+			f.langs[strings.ToLower(l)] = true
+		}
+	}
+	return f, nil
+}
+
+// matchPath checks the path against --match and --path. Globs without a
+// slash are matched against the base name, the others against the whole
+// path or any of its parent directories.
+func (f *fileFilter) matchPath(name string) bool {
+	if !f.match.MatchString(name) {
+		return false
+	}
+	if len(f.globs) == 0 {
+		return true
+	}
+	for _, g := range f.globs {
+		if !strings.Contains(g, "/") {
+			if ok, _ := path.Match(g, path.Base(name)); ok {
+				return true
+			}
+			continue
+		}
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if ok, _ := path.Match(g, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchLanguage checks the language of the file against --file-lang.
+func (f *fileFilter) matchLanguage(name string, content []byte) bool {
+	if f.langs == nil {
+		return true
+	}
+	return f.langs[strings.ToLower(enry.GetLanguage(path.Base(name), content))]
+}
+
+// dumpWriter writes the files of a tree somewhere.
+type dumpWriter interface {
+	File(name string, mode filemode.FileMode, content []byte, modTime time.Time) error
+	Symlink(name, target string, modTime time.Time) error
+	Close() error
+}
+
+// dirDumpWriter writes the files to a directory and their names to w.
+type dirDumpWriter struct {
+	dir string
+	w   io.Writer
+}
+
+func (w dirDumpWriter) File(name string, mode filemode.FileMode, content []byte, _ time.Time) error {
+	fmt.Fprintln(w.w, name)
+	destPath := filepath.Join(w.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(destPath), 0777); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", filepath.Dir(destPath))
+	}
+	perm := os.FileMode(0666)
+	if mode == filemode.Executable {
+		perm = 0777
+	}
+	if err := ioutil.WriteFile(destPath, content, perm); err != nil {
+		return errors.Wrapf(err, "failed to write %s", destPath)
+	}
+	return nil
+}
+
+func (w dirDumpWriter) Symlink(name, target string, _ time.Time) error {
+	fmt.Fprintln(w.w, name)
+	destPath := filepath.Join(w.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(destPath), 0777); err != nil {
+		return errors.Wrapf(err, "failed to create directory %s", filepath.Dir(destPath))
+	}
+	_ = os.Remove(destPath)
+	return os.Symlink(target, destPath)
+}
+
+func (w dirDumpWriter) Close() error { return nil }
+
+type tarDumpWriter struct {
+	w      *tar.Writer
+	closer io.Closer
+}
+
+func (w *tarDumpWriter) File(name string, mode filemode.FileMode, content []byte, modTime time.Time) error {
+	perm := int64(0644)
+	if mode == filemode.Executable {
+		perm = 0755
+	}
+	err := w.w.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     perm,
+		Size:     int64(len(content)),
+		ModTime:  modTime,
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.w.Write(content)
+	return err
+}
+
+func (w *tarDumpWriter) Symlink(name, target string, modTime time.Time) error {
+	return w.w.WriteHeader(&tar.Header{
+		Name:     name,
+		Linkname: target,
+		Mode:     0777,
+		ModTime:  modTime,
+		Typeflag: tar.TypeSymlink,
+	})
+}
+
+func (w *tarDumpWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	return w.closer.Close()
+}
+
+type zipDumpWriter struct {
+	w      *zip.Writer
+	closer io.Closer
+}
+
+func (w *zipDumpWriter) write(name string, mode os.FileMode, content []byte, modTime time.Time) error {
+	h := &zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime}
+	h.SetMode(mode)
+	fw, err := w.w.CreateHeader(h)
+	if err != nil {
+		return err
+	}
+	_, err = fw.Write(content)
+	return err
+}
+
+func (w *zipDumpWriter) File(name string, mode filemode.FileMode, content []byte, modTime time.Time) error {
+	perm := os.FileMode(0644)
+	if mode == filemode.Executable {
+		perm = 0755
+	}
+	return w.write(name, perm, content, modTime)
+}
+
+func (w *zipDumpWriter) Symlink(name, target string, modTime time.Time) error {
+	return w.write(name, os.ModeSymlink|0777, []byte(target), modTime)
+}
+
+func (w *zipDumpWriter) Close() error {
+	if err := w.w.Close(); err != nil {
+		return err
+	}
+	return w.closer.Close()
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// newDumpWriter returns the writer for the given format. Archives are
+// written to the output path, or to out if it is - or the default current
+// directory.
+func newDumpWriter(format, output string, out *sivaOutput) (dumpWriter, error) {
+	if format == "" || format == "dir" {
+		return dirDumpWriter{dir: output, w: out}, nil
+	}
+	if out.batch() {
+		return nil, errBatchFormat(format)
+	}
+
+	var (
+		w      io.Writer = out
+		closer io.Closer = nopCloser{}
+	)
+	if output != "-" && output != "." {
+		f, err := os.Create(output)
+		if err != nil {
+			return nil, err
+		}
+		w, closer = f, f
+	}
+	switch format {
+	case "tar":
+		return &tarDumpWriter{w: tar.NewWriter(w), closer: closer}, nil
+	case "zip":
+		return &zipDumpWriter{w: zip.NewWriter(w), closer: closer}, nil
+	default:
+		_ = closer.Close()
+		return nil, fmt.Errorf("unknown format in --format %q (choose from dir, tar, zip)", format)
+	}
+}
+
+// dump writes the files of the selected revisions of each repository.
+func dump(flags *pflag.FlagSet, fileName string, out *sivaOutput) (err error) {
+	output, err := flags.GetString("output")
+	if err != nil {
+		return errors.Wrapf(err, "required command line argument: -o/--output")
+	}
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	symlinks, err := flags.GetString("symlinks")
+	if err != nil {
+		return err
+	}
+	if symlinks != "link" && symlinks != "file" && symlinks != "skip" {
+		return fmt.Errorf("unknown value in --symlinks %q (choose from link, file, skip)", symlinks)
+	}
+	filter, err := fileFilterFromFlags(flags)
+	if err != nil {
+		return err
+	}
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	if !out.batch() {
+		fmt.Fprint(os.Stderr, "Reading the references, this may take some time... ")
+	}
+	targets, err := dumpTargets(archive, flags)
+	if !out.batch() {
+		fmt.Fprintln(os.Stderr, "done.")
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to select the revisions in %s", fileName)
+	}
+	if len(targets) == 0 {
+		return fmt.Errorf("no revision to dump in %s", fileName)
+	}
+
+	w, err := newDumpWriter(format, output, out)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+	}()
+	for _, target := range targets {
+		if err := dumpFiles(target.commit, target.key, filter, symlinks, w); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dumpFiles(commit *object.Commit, prefix string, filter *fileFilter,
+	symlinks string, w dumpWriter) error {
+
+	tree, err := commit.Tree()
+	if err != nil {
+		return errors.Wrapf(err, "could not read the tree from %s", commit.Hash.String())
+	}
+	modTime := commit.Committer.When
+	return tree.Files().ForEach(func(file *object.File) error {
+		if !filter.matchPath(file.Name) {
+			return nil
+		}
+		switch file.Mode {
+		case filemode.Regular, filemode.Deprecated, filemode.Executable:
+		case filemode.Symlink:
+			if symlinks == "skip" {
+				return nil
+			}
+		default:
+			return nil
+		}
+		content, err := readBlob(file)
+		if err != nil {
+			return err
+		}
+		if !filter.matchLanguage(file.Name, content) {
+			return nil
+		}
+		name := path.Join(prefix, file.Name)
+		if file.Mode == filemode.Symlink && symlinks == "link" {
+			return w.Symlink(name, string(content), modTime)
+		}
+		if err := w.File(name, file.Mode, content, modTime); err != nil {
+			return errors.Wrapf(err, "failed to write %s from %s", name, file.Hash.String())
+		}
+		return nil
+	})
+}
+
+func readBlob(file *object.File) ([]byte, error) {
+	reader, err := file.Reader()
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s %s", file.Name, file.Hash.String())
+	}
+	defer reader.Close()
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read %s %s", file.Name, file.Hash.String())
+	}
+	return content, nil
+}
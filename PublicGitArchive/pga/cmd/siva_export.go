@@ -0,0 +1,199 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/format/packfile"
+	"gopkg.in/src-d/go-git.v4/plumbing/revlist"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// packWindow is the size of the window used to find deltas when writing packfiles.
+const packWindow = 10
+
+// hasReference returns whether refs has a reference with the given name.
+func hasReference(refs []*plumbing.Reference, name plumbing.ReferenceName) bool {
+	for _, ref := range refs {
+		if ref.Name() == name {
+			return true
+		}
+	}
+	return false
+}
+
+// reachableObjects returns the hashes of all the objects reachable from refs.
+func reachableObjects(s storer.EncodedObjectStorer, refs []*plumbing.Reference, head *plumbing.Reference) ([]plumbing.Hash, error) {
+	var hashes []plumbing.Hash
+	for _, ref := range refs {
+		hashes = append(hashes, ref.Hash())
+	}
+	if head != nil && head.Type() == plumbing.HashReference {
+		hashes = append(hashes, head.Hash())
+	}
+	return revlist.Objects(s, hashes, nil)
+}
+
+// export writes a single repository of a rooted siva file as a bare
+// repository or as a bundle, with its references renamed back to
+// refs/heads/* and refs/tags/*.
+func export(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	output, err := flags.GetString("output")
+	if err != nil {
+		return err
+	}
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	uuid, err := repositoryFlag(flags, archive)
+	if err != nil {
+		return err
+	}
+	if uuid == "" {
+		return fmt.Errorf("required command line argument: --repo")
+	}
+	repo, err := archive.Repository(uuid)
+	if err != nil {
+		return errors.Wrapf(err, "unable to open %s in %s", uuid, fileName)
+	}
+	iter, err := repo.References()
+	if err != nil {
+		return errors.Wrapf(err, "unable to list Git references in %s", fileName)
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Name().IsBranch() || ref.Name().IsTag() {
+			refs = append(refs, ref)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to list Git references in %s", fileName)
+	}
+	head, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read the HEAD of %s", uuid)
+	}
+	if head.Type() == plumbing.SymbolicReference && !hasReference(refs, head.Target()) {
+		// The repository has no HEAD, the export keeps the default one.
+		head = nil
+	}
+	hashes, err := reachableObjects(repo.Storer, refs, head)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the objects of %s", uuid)
+	}
+
+	switch format {
+	case "", "bare":
+		path := filepath.Join(output, uuid+".git")
+		if err := exportBare(repo.Repository, path, refs, head, hashes); err != nil {
+			return errors.Wrapf(err, "unable to export %s", uuid)
+		}
+		fmt.Fprintln(out, path)
+	case "bundle":
+		path := filepath.Join(output, uuid+".bundle")
+		if err := exportBundle(repo.Repository, path, refs, head, hashes); err != nil {
+			return errors.Wrapf(err, "unable to export %s", uuid)
+		}
+		fmt.Fprintln(out, path)
+	default:
+		return fmt.Errorf("unknown format in --format %q (choose from bare, bundle)", format)
+	}
+	return nil
+}
+
+func exportBare(repo *git.Repository, path string, refs []*plumbing.Reference,
+	head *plumbing.Reference, hashes []plumbing.Hash) error {
+
+	dst, err := git.PlainInit(path, true)
+	if err != nil {
+		return err
+	}
+	pw, ok := dst.Storer.(storer.PackfileWriter)
+	if !ok {
+		return fmt.Errorf("the storage of %s can not write packfiles", path)
+	}
+	w, err := pw.PackfileWriter()
+	if err != nil {
+		return err
+	}
+	if _, err := packfile.NewEncoder(w, repo.Storer, false).Encode(hashes, packWindow); err != nil {
+		_ = w.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	for _, ref := range refs {
+		if err := dst.Storer.SetReference(ref); err != nil {
+			return err
+		}
+	}
+	if head != nil {
+		return dst.Storer.SetReference(head)
+	}
+	return nil
+}
+
+// exportBundle writes a v2 git bundle, see
+// https://git-scm.com/docs/bundle-format.
+func exportBundle(repo *git.Repository, path string, refs []*plumbing.Reference,
+	head *plumbing.Reference, hashes []plumbing.Hash) (err error) {
+
+	if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	if _, err := io.WriteString(w, "# v2 git bundle\n"); err != nil {
+		return err
+	}
+	if head != nil {
+		hash := head.Hash()
+		if head.Type() == plumbing.SymbolicReference {
+			for _, ref := range refs {
+				if ref.Name() == head.Target() {
+					hash = ref.Hash()
+				}
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s HEAD\n", hash); err != nil {
+			return err
+		}
+	}
+	for _, ref := range refs {
+		if _, err := fmt.Fprintf(w, "%s %s\n", ref.Hash(), ref.Name()); err != nil {
+			return err
+		}
+	}
+	if _, err := io.WriteString(w, "\n"); err != nil {
+		return err
+	}
+	if _, err := packfile.NewEncoder(w, repo.Storer, false).Encode(hashes, packWindow); err != nil {
+		return err
+	}
+	return w.Flush()
+}
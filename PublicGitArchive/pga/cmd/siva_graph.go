@@ -0,0 +1,309 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+)
+
+// graphWriter streams the commit graph of a siva file in a given format.
+type graphWriter interface {
+	// Node writes a commit, refs are the names of the references pointing to it.
+	Node(c *object.Commit, refs []string) error
+	// Close writes the references and finishes the output.
+	Close(refs []*plumbing.Reference) error
+}
+
+func newGraphWriter(format string, w *bufio.Writer) (graphWriter, error) {
+	switch format {
+	case "", "json":
+		_, err := w.WriteString("{\n\t\"commits\": {")
+		return &jsonGraphWriter{w: w, first: true}, err
+	case "graphml":
+		_, err := w.WriteString(xml.Header +
+			`<graphml xmlns="http://graphml.graphdrawing.org/xmlns">` + "\n" +
+			`  <key id="refs" for="node" attr.name="references" attr.type="string"/>` + "\n" +
+			`  <graph id="commits" edgedefault="directed">` + "\n")
+		return &graphMLWriter{w}, err
+	case "dot":
+		_, err := w.WriteString("digraph commits {\n")
+		return &dotGraphWriter{w}, err
+	default:
+		return nil, fmt.Errorf("unknown format in --format %q (choose from json, graphml, dot)", format)
+	}
+}
+
+func quote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+type jsonGraphWriter struct {
+	w     *bufio.Writer
+	first bool
+}
+
+func (g *jsonGraphWriter) Node(c *object.Commit, refs []string) error {
+	hashes := make([]string, 0, len(c.ParentHashes))
+	for _, h := range c.ParentHashes {
+		hashes = append(hashes, quote(h.String()))
+	}
+	sep := ","
+	if g.first {
+		sep, g.first = "", false
+	}
+	_, err := fmt.Fprintf(g.w, "%s\n\t\t%s: [%s]", sep, quote(c.Hash.String()), strings.Join(hashes, ", "))
+	return err
+}
+
+func (g *jsonGraphWriter) Close(refs []*plumbing.Reference) error {
+	if _, err := g.w.WriteString("\n\t},\n\t\"references\": {"); err != nil {
+		return err
+	}
+	for i, ref := range refs {
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		_, err := fmt.Fprintf(g.w, "%s\n\t\t%s: %s", sep, quote(ref.Name().String()), quote(ref.Hash().String()))
+		if err != nil {
+			return err
+		}
+	}
+	_, err := g.w.WriteString("\n\t}\n}\n")
+	return err
+}
+
+type graphMLWriter struct{ w *bufio.Writer }
+
+func escapeXML(s string) string {
+	var b strings.Builder
+	_ = xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+func (g *graphMLWriter) Node(c *object.Commit, refs []string) error {
+	hash := c.Hash.String()
+	var err error
+	if len(refs) == 0 {
+		_, err = fmt.Fprintf(g.w, "    <node id=\"%s\"/>\n", hash)
+	} else {
+		_, err = fmt.Fprintf(g.w, "    <node id=\"%s\"><data key=\"refs\">%s</data></node>\n",
+			hash, escapeXML(strings.Join(refs, ",")))
+	}
+	if err != nil {
+		return err
+	}
+	for _, p := range c.ParentHashes {
+		if _, err := fmt.Fprintf(g.w, "    <edge source=\"%s\" target=\"%s\"/>\n", hash, p.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *graphMLWriter) Close(refs []*plumbing.Reference) error {
+	_, err := g.w.WriteString("  </graph>\n</graphml>\n")
+	return err
+}
+
+type dotGraphWriter struct{ w *bufio.Writer }
+
+// dotEscaper escapes a string within a double-quoted DOT ID, where newlines
+// are written as \n to break the lines of a label.
+var dotEscaper = strings.NewReplacer(`"`, `\"`, `\`, `\\`, "\n", `\n`)
+
+func quoteDOT(s string) string {
+	return `"` + dotEscaper.Replace(s) + `"`
+}
+
+func (g *dotGraphWriter) Node(c *object.Commit, refs []string) error {
+	hash := c.Hash.String()
+	label := append([]string{hash[:7]}, refs...)
+	if _, err := fmt.Fprintf(g.w, "\t%s [label=%s];\n", quoteDOT(hash), quoteDOT(strings.Join(label, "\n"))); err != nil {
+		return err
+	}
+	for _, p := range c.ParentHashes {
+		if _, err := fmt.Fprintf(g.w, "\t%s -> %s;\n", quoteDOT(hash), quoteDOT(p.String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (g *dotGraphWriter) Close(refs []*plumbing.Reference) error {
+	_, err := g.w.WriteString("}\n")
+	return err
+}
+
+// repositoryReferences returns the references of the rooted repository with a
+// target, sorted by name. If uuid is not empty only the references of that
+// repository, which end with /<uuid>, are returned.
+func repositoryReferences(repo *git.Repository, uuid string) ([]*plumbing.Reference, error) {
+	iter, err := repo.References()
+	if err != nil {
+		return nil, err
+	}
+	var refs []*plumbing.Reference
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		if ref.Hash() == plumbing.ZeroHash {
+			return nil
+		}
+		if uuid != "" && !strings.HasSuffix(ref.Name().String(), "/"+uuid) {
+			return nil
+		}
+		refs = append(refs, ref)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+	return refs, nil
+}
+
+// list streams the commit graph of a siva file. With --repo only the history
+// reachable from the references of that repository is written.
+func list(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	repo := archive.Rooted
+	uuid, err := repositoryFlag(flags, archive)
+	if err != nil {
+		return err
+	}
+	refs, err := repositoryReferences(repo, uuid)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list Git references in %s", fileName)
+	}
+	if uuid != "" && len(refs) == 0 {
+		return fmt.Errorf("repository %s not found in %s", uuid, fileName)
+	}
+	// Annotated tags label the commit they point to.
+	labels := map[plumbing.Hash][]string{}
+	for _, ref := range refs {
+		h := ref.Hash()
+		if c, err := peelCommit(repo, h); err == nil {
+			h = c.Hash
+		}
+		labels[h] = append(labels[h], ref.Name().String())
+	}
+
+	var commits object.CommitIter
+	if uuid == "" {
+		commits, err = repo.CommitObjects()
+	} else {
+		commits, err = reachableCommits(repo, refs)
+	}
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(out)
+	g, err := newGraphWriter(format, w)
+	if err != nil {
+		return err
+	}
+	err = commits.ForEach(func(c *object.Commit) error {
+		return g.Node(c, labels[c.Hash])
+	})
+	if err != nil {
+		return err
+	}
+	if err := g.Close(refs); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// reachableCommits returns an iterator over the commits reachable from refs.
+// References not pointing to commits, such as annotated tags, are peeled.
+func reachableCommits(repo *git.Repository, refs []*plumbing.Reference) (object.CommitIter, error) {
+	var heads []*object.Commit
+	for _, ref := range refs {
+		c, err := peelCommit(repo, ref.Hash())
+		if err == plumbing.ErrObjectNotFound || err == object.ErrUnsupportedObject {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		heads = append(heads, c)
+	}
+	it := &multiCommitIter{seen: map[plumbing.Hash]bool{}}
+	for _, head := range heads {
+		it.iters = append(it.iters, object.NewCommitPreorderIter(head, it.seen, nil))
+	}
+	return it, nil
+}
+
+func peelCommit(repo *git.Repository, h plumbing.Hash) (*object.Commit, error) {
+	if tag, err := repo.TagObject(h); err == nil {
+		return tag.Commit()
+	}
+	return repo.CommitObject(h)
+}
+
+// multiCommitIter chains several commit iterators, skipping the commits
+// already returned by the previous ones.
+type multiCommitIter struct {
+	iters []object.CommitIter
+	seen  map[plumbing.Hash]bool
+}
+
+func (it *multiCommitIter) Next() (*object.Commit, error) {
+	for len(it.iters) > 0 {
+		c, err := it.iters[0].Next()
+		if err == io.EOF {
+			it.iters[0].Close()
+			it.iters = it.iters[1:]
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		it.seen[c.Hash] = true
+		return c, nil
+	}
+	return nil, io.EOF
+}
+
+func (it *multiCommitIter) ForEach(f func(*object.Commit) error) error {
+	defer it.Close()
+	for {
+		c, err := it.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := f(c); err == storer.ErrStop {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+func (it *multiCommitIter) Close() {
+	for _, iter := range it.iters {
+		iter.Close()
+	}
+	it.iters = nil
+}
@@ -0,0 +1,187 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+
+	enry "github.com/go-enry/go-enry/v2"
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/filemode"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// grepMatch is a line of a file in the HEAD of a repository matching the
+// regular expression.
+type grepMatch struct {
+	Siva       string `json:"siva"`
+	Repository string `json:"repository"`
+	Head       string `json:"head"`
+	Path       string `json:"path"`
+	Line       int    `json:"line"`
+	Match      string `json:"match"`
+}
+
+// grepLine is a matching line of a blob, shared by all the files with the
+// same contents.
+type grepLine struct {
+	number int
+	text   string
+}
+
+// grepBlob holds the matching lines of a blob, and its contents to detect
+// its language at each path if there are any.
+type grepBlob struct {
+	lines   []grepLine
+	content []byte
+}
+
+// newGrepEncoder returns the function writing each match in the given format.
+func newGrepEncoder(format string, w io.Writer) (func(m *grepMatch) error, error) {
+	switch format {
+	case "":
+		return func(m *grepMatch) error {
+			_, err := fmt.Fprintf(w, "%s:%s:%s:%d:%s\n", m.Repository, m.Head, m.Path, m.Line, m.Match)
+			return err
+		}, nil
+	case "jsonl":
+		e := json.NewEncoder(w)
+		return func(m *grepMatch) error { return e.Encode(m) }, nil
+	default:
+		return nil, fmt.Errorf("unknown format in --format %q (choose from jsonl)", format)
+	}
+}
+
+// grep looks for a regular expression in the HEAD blobs of every repository
+// in a siva file.
+func grep(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	if flags.NArg() != 3 {
+		return fmt.Errorf("usage: pga siva grep /path/to/siva/directory/or/glob regexp")
+	}
+	re, err := newGrepPattern(flags.Arg(2))
+	if err != nil {
+		return fmt.Errorf("invalid regular expression %q: %v", flags.Arg(2), err)
+	}
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	binary, err := flags.GetBool("binary")
+	if err != nil {
+		return err
+	}
+	filter, err := fileFilterFromFlags(flags)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	encode, err := newGrepEncoder(format, w)
+	if err != nil {
+		return err
+	}
+
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	repo := archive.Rooted
+	heads, err := repositoryHeads(repo, "")
+	if err != nil {
+		return err
+	}
+	// Repositories in the same siva file share most of their blobs. The
+	// matches only depend on the contents, the language also on the path.
+	blobs := map[plumbing.Hash]*grepBlob{}
+	for _, id := range sortedKeys(heads) {
+		c, err := peelCommit(repo, heads[id])
+		if err != nil {
+			return errors.Wrapf(err, "failed to load %s", heads[id].String())
+		}
+		tree, err := c.Tree()
+		if err != nil {
+			return errors.Wrapf(err, "could not read the tree from %s", c.Hash.String())
+		}
+		err = tree.Files().ForEach(func(file *object.File) error {
+			if file.Mode == filemode.Symlink || file.Mode == filemode.Submodule || !filter.matchPath(file.Name) {
+				return nil
+			}
+			blob, seen := blobs[file.Hash]
+			if !seen {
+				content, err := readBlob(file)
+				if err != nil {
+					return err
+				}
+				blob = &grepBlob{}
+				if binary || !enry.IsBinary(content) {
+					blob.lines = re.grep(content)
+				}
+				if len(blob.lines) > 0 {
+					blob.content = content
+				}
+				blobs[file.Hash] = blob
+			}
+			lines := blob.lines
+			if len(lines) > 0 && !filter.matchLanguage(file.Name, blob.content) {
+				lines = nil
+			}
+			for _, l := range lines {
+				err := encode(&grepMatch{
+					Siva:       fileName,
+					Repository: id,
+					Head:       c.Hash.String(),
+					Path:       file.Name,
+					Line:       l.number,
+					Match:      l.text,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// grepPattern is the regular expression matched against each line. File
+// matches any line of a whole file, to skip splitting most files in lines.
+// It is nil if $ is used, which would not match before \r\n.
+type grepPattern struct {
+	line, file *regexp.Regexp
+}
+
+func newGrepPattern(expr string) (*grepPattern, error) {
+	line, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &grepPattern{line: line}
+	if !strings.Contains(expr, "$") {
+		p.file = regexp.MustCompile("(?m)" + expr)
+	}
+	return p, nil
+}
+
+func (p *grepPattern) grep(content []byte) []grepLine {
+	if p.file != nil && !p.file.Match(content) {
+		return nil
+	}
+	var lines []grepLine
+	for i, line := range bytes.Split(content, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if p.line.Match(line) {
+			lines = append(lines, grepLine{number: i + 1, text: string(line)})
+		}
+	}
+	return lines
+}
@@ -0,0 +1,240 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/source"
+	"github.com/xitongsys/parquet-go/writer"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// commitRecord contains the metadata of a commit reachable from the HEAD of a repository.
+type commitRecord struct {
+	Repository     string       `json:"repository"`
+	Hash           string       `json:"hash"`
+	Parents        []string     `json:"parents"`
+	AuthorName     string       `json:"authorName"`
+	AuthorEmail    string       `json:"authorEmail"`
+	AuthorDate     time.Time    `json:"authorDate"`
+	CommitterName  string       `json:"committerName"`
+	CommitterEmail string       `json:"committerEmail"`
+	CommitterDate  time.Time    `json:"committerDate"`
+	Message        string       `json:"message"`
+	FilesChanged   int          `json:"filesChanged"`
+	Additions      int          `json:"additions"`
+	Deletions      int          `json:"deletions"`
+	Files          []fileChange `json:"files"`
+}
+
+type fileChange struct {
+	Name      string `json:"name"`
+	Additions int    `json:"additions"`
+	Deletions int    `json:"deletions"`
+}
+
+var commitCSVHeaders = []string{
+	"REPOSITORY", "HASH", "PARENTS", "AUTHOR_NAME", "AUTHOR_EMAIL", "AUTHOR_DATE",
+	"COMMITTER_NAME", "COMMITTER_EMAIL", "COMMITTER_DATE", "MESSAGE",
+	"FILES_CHANGED", "ADDITIONS", "DELETIONS",
+}
+
+func (r *commitRecord) toCSV() []string {
+	return []string{
+		r.Repository,
+		r.Hash,
+		strings.Join(r.Parents, ","),
+		r.AuthorName,
+		r.AuthorEmail,
+		r.AuthorDate.Format(time.RFC3339),
+		r.CommitterName,
+		r.CommitterEmail,
+		r.CommitterDate.Format(time.RFC3339),
+		r.Message,
+		strconv.Itoa(r.FilesChanged),
+		strconv.Itoa(r.Additions),
+		strconv.Itoa(r.Deletions),
+	}
+}
+
+// parquetCommit is the Parquet schema of commitRecord.
+type parquetCommit struct {
+	Repository     string `parquet:"name=repository, type=UTF8, encoding=PLAIN_DICTIONARY"`
+	Hash           string `parquet:"name=hash, type=UTF8"`
+	Parents        string `parquet:"name=parents, type=UTF8"`
+	AuthorName     string `parquet:"name=author_name, type=UTF8"`
+	AuthorEmail    string `parquet:"name=author_email, type=UTF8"`
+	AuthorDate     int64  `parquet:"name=author_date, type=TIMESTAMP_MILLIS"`
+	CommitterName  string `parquet:"name=committer_name, type=UTF8"`
+	CommitterEmail string `parquet:"name=committer_email, type=UTF8"`
+	CommitterDate  int64  `parquet:"name=committer_date, type=TIMESTAMP_MILLIS"`
+	Message        string `parquet:"name=message, type=UTF8"`
+	FilesChanged   int32  `parquet:"name=files_changed, type=INT32"`
+	Additions      int32  `parquet:"name=additions, type=INT32"`
+	Deletions      int32  `parquet:"name=deletions, type=INT32"`
+}
+
+func (r *commitRecord) toParquet() *parquetCommit {
+	return &parquetCommit{
+		Repository:     r.Repository,
+		Hash:           r.Hash,
+		Parents:        strings.Join(r.Parents, ","),
+		AuthorName:     r.AuthorName,
+		AuthorEmail:    r.AuthorEmail,
+		AuthorDate:     r.AuthorDate.UnixNano() / int64(time.Millisecond),
+		CommitterName:  r.CommitterName,
+		CommitterEmail: r.CommitterEmail,
+		CommitterDate:  r.CommitterDate.UnixNano() / int64(time.Millisecond),
+		Message:        r.Message,
+		FilesChanged:   int32(r.FilesChanged),
+		Additions:      int32(r.Additions),
+		Deletions:      int32(r.Deletions),
+	}
+}
+
+func newCommitRecord(repository string, c *object.Commit) (*commitRecord, error) {
+	r := &commitRecord{
+		Repository:     repository,
+		Hash:           c.Hash.String(),
+		Parents:        make([]string, 0, len(c.ParentHashes)),
+		AuthorName:     c.Author.Name,
+		AuthorEmail:    c.Author.Email,
+		AuthorDate:     c.Author.When,
+		CommitterName:  c.Committer.Name,
+		CommitterEmail: c.Committer.Email,
+		CommitterDate:  c.Committer.When,
+		Message:        c.Message,
+		Files:          []fileChange{},
+	}
+	for _, h := range c.ParentHashes {
+		r.Parents = append(r.Parents, h.String())
+	}
+	stats, err := c.Stats()
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not compute the stats of %s", c.Hash.String())
+	}
+	for _, s := range stats {
+		r.Files = append(r.Files, fileChange{Name: s.Name, Additions: s.Addition, Deletions: s.Deletion})
+		r.Additions += s.Addition
+		r.Deletions += s.Deletion
+	}
+	r.FilesChanged = len(stats)
+	return r, nil
+}
+
+// commitWriter writes commit records in a given format.
+type commitWriter interface {
+	Write(r *commitRecord) error
+	Close() error
+}
+
+func newCommitWriter(format string, out *sivaOutput) (commitWriter, error) {
+	switch format {
+	case "", "jsonl":
+		return jsonlCommitWriter{json.NewEncoder(out)}, nil
+	case "csv":
+		if err := out.csvHeader(commitCSVHeaders); err != nil {
+			return nil, err
+		}
+		return csvCommitWriter{csv.NewWriter(out)}, nil
+	case "parquet":
+		if out.batch() {
+			return nil, errBatchFormat(format)
+		}
+		pw, err := writer.NewParquetWriter(streamFile{out}, new(parquetCommit), 1)
+		if err != nil {
+			return nil, err
+		}
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+		return parquetCommitWriter{pw}, nil
+	default:
+		return nil, fmt.Errorf("unknown format in --format %q (choose from jsonl, csv, parquet)", format)
+	}
+}
+
+type jsonlCommitWriter struct{ e *json.Encoder }
+
+func (w jsonlCommitWriter) Write(r *commitRecord) error { return w.e.Encode(r) }
+func (w jsonlCommitWriter) Close() error                { return nil }
+
+type csvCommitWriter struct{ w *csv.Writer }
+
+func (w csvCommitWriter) Write(r *commitRecord) error { return w.w.Write(r.toCSV()) }
+
+func (w csvCommitWriter) Close() error {
+	w.w.Flush()
+	return w.w.Error()
+}
+
+type parquetCommitWriter struct{ w *writer.ParquetWriter }
+
+func (w parquetCommitWriter) Write(r *commitRecord) error { return w.w.Write(r.toParquet()) }
+func (w parquetCommitWriter) Close() error                { return w.w.WriteStop() }
+
+// streamFile adapts an io.Writer to the file interface needed to write
+// Parquet, which only needs to write sequentially.
+type streamFile struct{ io.Writer }
+
+func (f streamFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, fmt.Errorf("seek not supported")
+}
+func (f streamFile) Read(p []byte) (int, error) { return 0, fmt.Errorf("read not supported") }
+func (f streamFile) Close() error               { return nil }
+func (f streamFile) Open(name string) (source.ParquetFile, error) {
+	return nil, fmt.Errorf("open not supported")
+}
+func (f streamFile) Create(name string) (source.ParquetFile, error) { return f, nil }
+
+// logCommits writes the metadata of every commit reachable from the HEAD of
+// each repository, or only from the one selected with --repo.
+func logCommits(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	repo := archive.Rooted
+	uuid, err := repositoryFlag(flags, archive)
+	if err != nil {
+		return err
+	}
+	heads, err := repositoryHeads(repo, uuid)
+	if err != nil {
+		return errors.Wrapf(err, "unable to read the heads in %s", fileName)
+	}
+	w, err := newCommitWriter(format, out)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range sortedKeys(heads) {
+		iter, err := repo.Log(&git.LogOptions{From: heads[id]})
+		if err != nil {
+			return errors.Wrapf(err, "unable to read the history of %s", id)
+		}
+		err = iter.ForEach(func(c *object.Commit) error {
+			r, err := newCommitRecord(id, c)
+			if err != nil {
+				return err
+			}
+			return w.Write(r)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return w.Close()
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga/sivarepo"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+)
+
+// repositoryInfo describes one of the repositories in a rooted siva file.
+type repositoryInfo struct {
+	UUID           string     `json:"uuid"`
+	URLs           []string   `json:"urls"`
+	References     int        `json:"references"`
+	HEAD           string     `json:"head,omitempty"`
+	LastCommitDate *time.Time `json:"lastCommitDate,omitempty"`
+}
+
+// rootedRepositories describes the repositories in a siva file.
+func rootedRepositories(archive *sivarepo.Archive) ([]*repositoryInfo, error) {
+	repos, err := archive.Repositories()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]*repositoryInfo, 0, len(repos))
+	for _, r := range repos {
+		info := &repositoryInfo{UUID: r.ID, URLs: append([]string{}, r.URLs...)}
+		refs, err := r.References()
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to list Git references")
+		}
+		err = refs.ForEach(func(ref *plumbing.Reference) error {
+			if ref.Name() == plumbing.HEAD {
+				return nil
+			}
+			info.References++
+			info.addCommit(r.Repository, ref.Hash())
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, "unable to list Git references")
+		}
+		if head, err := r.Head(); err == nil {
+			info.References++
+			info.HEAD = head.Hash().String()
+			info.addCommit(r.Repository, head.Hash())
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// addCommit updates the date of the last commit with the commit pointed by h,
+// if it points to one.
+func (info *repositoryInfo) addCommit(repo *git.Repository, h plumbing.Hash) {
+	c, err := peelCommit(repo, h)
+	if err == nil && (info.LastCommitDate == nil || c.Committer.When.After(*info.LastCommitDate)) {
+		when := c.Committer.When
+		info.LastCommitDate = &when
+	}
+}
+
+// resolveRepositoryID returns the UUID of the repository in the siva file
+// identified by the given UUID or remote URL.
+func resolveRepositoryID(archive *sivarepo.Archive, idOrURL string) (string, error) {
+	r, err := archive.Repository(idOrURL)
+	if err == sivarepo.ErrRepositoryNotFound {
+		return "", fmt.Errorf("repository %s not found", idOrURL)
+	} else if err != nil {
+		return "", err
+	}
+	return r.ID, nil
+}
+
+// repos lists the repositories contained in a rooted siva file.
+func repos(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	infos, err := rootedRepositories(archive)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the repositories in %s", fileName)
+	}
+
+	formatDate := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	switch format {
+	case "":
+		// With several siva files each one gets its own table, like ls does
+		// with several directories.
+		if out.batch() {
+			fmt.Fprintf(out, "%s:\n", fileName)
+		}
+		w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "UUID\tURLS\tREFS\tHEAD\tLAST COMMIT")
+		for _, info := range infos {
+			fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\n", info.UUID, strings.Join(info.URLs, ","),
+				info.References, info.HEAD, formatDate(info.LastCommitDate))
+		}
+		return w.Flush()
+	case "json":
+		e := json.NewEncoder(out)
+		for _, info := range infos {
+			if err := e.Encode(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "csv":
+		if err := out.csvHeader([]string{"UUID", "URLS", "REFS", "HEAD", "LAST_COMMIT_DATE"}); err != nil {
+			return err
+		}
+		w := csv.NewWriter(out)
+		for _, info := range infos {
+			err := w.Write([]string{info.UUID, strings.Join(info.URLs, ","),
+				strconv.Itoa(info.References), info.HEAD, formatDate(info.LastCommitDate)})
+			if err != nil {
+				return err
+			}
+		}
+		w.Flush()
+		return w.Error()
+	default:
+		return fmt.Errorf("unknown format in --format %q (choose from json, csv)", format)
+	}
+}
@@ -0,0 +1,284 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	enry "github.com/go-enry/go-enry/v2"
+	"github.com/go-enry/go-license-detector/v4/licensedb"
+	"github.com/go-enry/go-license-detector/v4/licensedb/filer"
+	"github.com/hhatto/gocloc"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+)
+
+// The statistics below are computed like the indexer of pga-create does, so
+// that the rows can be compared with the ones of the siva index.
+
+type languageUsage struct {
+	Files int64
+	Bytes int64
+	Lines int64
+}
+
+type lineCounts struct {
+	Blank    int64
+	Code     int64
+	Comments int64
+}
+
+// headFile is a file of the HEAD tree with its contents.
+type headFile struct {
+	name    string
+	content []byte
+}
+
+// repositoryURL returns the first GitHub URL, or the first URL.
+func repositoryURL(urls []string) string {
+	for _, u := range urls {
+		if strings.Contains(u, "github.com") {
+			return u
+		}
+	}
+	if len(urls) == 0 {
+		return ""
+	}
+	return urls[0]
+}
+
+func headFiles(commit *object.Commit) ([]headFile, error) {
+	iter, err := commit.Files()
+	if err != nil {
+		return nil, err
+	}
+	var files []headFile
+	err = iter.ForEach(func(f *object.File) error {
+		content, err := readBlob(f)
+		if err != nil {
+			return err
+		}
+		files = append(files, headFile{name: f.Name, content: content})
+		return nil
+	})
+	return files, err
+}
+
+func languageUsages(files []headFile) map[string]languageUsage {
+	usages := map[string]languageUsage{}
+	for _, f := range files {
+		lang := enry.GetLanguage(f.name, f.content)
+		if lang == "" {
+			continue
+		}
+		u := usages[lang]
+		u.Files++
+		u.Bytes += int64(len(f.content))
+		u.Lines += int64(strings.Count(string(f.content), "\n") + 1)
+		usages[lang] = u
+	}
+	return usages
+}
+
+// writeHeadFiles writes the files to a temporary directory, gocloc and the
+// license detector only read files from disk.
+func writeHeadFiles(files []headFile) (dir string, err error) {
+	dir, err = ioutil.TempDir("", "pga-stats")
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		if err != nil {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	for _, f := range files {
+		path := filepath.Join(dir, filepath.FromSlash(f.name))
+		if !strings.HasPrefix(path, dir+string(filepath.Separator)) {
+			return "", fmt.Errorf("invalid file name %s", f.name)
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0777); err != nil {
+			return "", err
+		}
+		if err := ioutil.WriteFile(path, f.content, 0666); err != nil {
+			return "", err
+		}
+	}
+	return dir, nil
+}
+
+func countLines(dir string, files []headFile) (map[string]lineCounts, error) {
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = filepath.Join(dir, filepath.FromSlash(f.name))
+	}
+	proc := gocloc.NewProcessor(gocloc.NewDefinedLanguages(), gocloc.NewClocOptions())
+	result, err := proc.Analyze(paths)
+	if err != nil {
+		return nil, err
+	}
+	counts := map[string]lineCounts{}
+	for lang, c := range result.Languages {
+		counts[lang] = lineCounts{
+			Blank:    int64(c.Blanks),
+			Code:     int64(c.Code),
+			Comments: int64(c.Comments),
+		}
+	}
+	return counts, nil
+}
+
+func detectLicenses(dir string) string {
+	loader, err := filer.FromDirectory(dir)
+	if err != nil {
+		return ""
+	}
+	licenses, err := licensedb.Detect(loader)
+	if err != nil {
+		return ""
+	}
+	names := make([]string, 0, len(licenses))
+	for name := range licenses {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s:%.3f", name, licenses[name].Confidence)
+	}
+	return strings.Join(names, ",")
+}
+
+func countCommits(repo *git.Repository, head plumbing.Hash) (int64, error) {
+	iter, err := repo.Log(&git.LogOptions{From: head})
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	err = iter.ForEach(func(*object.Commit) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// repositoryStats computes the index row of a repository in a rooted siva
+// file. Stars are unknown, so they are -1.
+func repositoryStats(repo *git.Repository, info *repositoryInfo, sivaName string, size int64) (*pga.SivaRepository, error) {
+	r := &pga.SivaRepository{
+		URL:           repositoryURL(info.URLs),
+		SivaFilenames: []string{sivaName},
+		Stars:         -1,
+		Size:          size,
+	}
+	refs, err := repositoryReferences(repo, info.UUID)
+	if err != nil {
+		return nil, err
+	}
+	r.Branches = int64(len(refs))
+	if info.HEAD == "" {
+		logrus.Warnf("repository %s in %s has no HEAD", info.UUID, sivaName)
+		return r, nil
+	}
+
+	head, err := peelCommit(repo, plumbing.NewHash(info.HEAD))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load %s", info.HEAD)
+	}
+	if r.Commits, err = countCommits(repo, head.Hash); err != nil {
+		return nil, errors.Wrapf(err, "unable to count the commits of %s", info.UUID)
+	}
+	files, err := headFiles(head)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the files of %s", info.UUID)
+	}
+	r.Files = int64(len(files))
+	usages := languageUsages(files)
+
+	dir, err := writeHeadFiles(files)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to write the files of %s", info.UUID)
+	}
+	defer func() {
+		if err := os.RemoveAll(dir); err != nil {
+			logrus.Warnf("could not remove the temporary directory %s: %v", dir, err)
+		}
+	}()
+	counts, err := countLines(dir, files)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to count the lines of %s", info.UUID)
+	}
+	r.License = detectLicenses(dir)
+
+	for lang := range usages {
+		r.Languages = append(r.Languages, lang)
+	}
+	sort.Strings(r.Languages)
+	for _, lang := range r.Languages {
+		u, c := usages[lang], counts[lang]
+		r.LanguagesByteCount = append(r.LanguagesByteCount, u.Bytes)
+		r.LanguagesLineCount = append(r.LanguagesLineCount, u.Lines)
+		r.LanguagesFileCount = append(r.LanguagesFileCount, u.Files)
+		r.LanguagesEmptyLines = append(r.LanguagesEmptyLines, c.Blank)
+		r.LanguagesCodeLines = append(r.LanguagesCodeLines, c.Code)
+		r.LanguagesCommentLines = append(r.LanguagesCommentLines, c.Comments)
+	}
+	return r, nil
+}
+
+// stats writes the rows of the siva index for the repositories of a siva
+// file, or only the one selected with --repo.
+func stats(flags *pflag.FlagSet, fileName string, out *sivaOutput) error {
+	format, err := flags.GetString("format")
+	if err != nil {
+		return err
+	}
+	if format != "" && format != "csv" {
+		return fmt.Errorf("unknown format in --format %q (choose from csv)", format)
+	}
+	fi, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	archive, err := loadArchive(fileName)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	repo := archive.Rooted
+	uuid, err := repositoryFlag(flags, archive)
+	if err != nil {
+		return err
+	}
+	infos, err := rootedRepositories(archive)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the repositories in %s", fileName)
+	}
+
+	if err := out.csvHeader(pga.SivaCSVHeaders()); err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+	for _, info := range infos {
+		if uuid != "" && info.UUID != uuid {
+			continue
+		}
+		r, err := repositoryStats(repo, info, filepath.Base(fileName), fi.Size())
+		if err != nil {
+			return err
+		}
+		if err := w.Write(r.ToCSV()); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/pflag"
+)
+
+// contentStore is a local directory holding the downloaded files by their
+// MD5, in <xx>/<md5>. The files of each version are links to it, so that a
+// file which does not change between versions is downloaded and stored once.
+// An empty contentStore disables it.
+type contentStore string
+
+// storeFromFlags returns the store given with --store, which requires a local
+// output location.
+func storeFromFlags(flags *pflag.FlagSet, dest FileSystem) (contentStore, error) {
+	dir, err := flags.GetString("store")
+	if err != nil {
+		return "", err
+	}
+	if _, local := dest.(localFS); dir != "" && !local {
+		return "", fmt.Errorf("--store requires a local --output")
+	}
+	return contentStore(dir), nil
+}
+
+func (s contentStore) path(hash string) string {
+	return filepath.Join(string(s), hash[:2], hash)
+}
+
+func validMD5(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == 16
+}
+
+// has returns whether the store holds the file name of source, and its MD5.
+func (s contentStore) has(source FileSystem, name string) (bool, string) {
+	if s == "" {
+		return false, ""
+	}
+	hash, err := source.MD5(name)
+	if err != nil || !validMD5(hash) {
+		return false, ""
+	}
+	_, err = os.Stat(s.path(hash))
+	return err == nil, hash
+}
+
+// update makes name in dest up to date with source. If the store already has
+// the file with the MD5 of the source, it is linked instead of downloaded,
+// otherwise it is downloaded, hashed on the way, and added to the store.
+func (s contentStore) update(ctx context.Context, dest, source FileSystem, name string, bw *rateLimiter) error {
+	if s == "" {
+		return updateCache(ctx, dest, source, name, bw)
+	}
+	stored, hash := s.has(source, name)
+	if hash == "" {
+		logrus.Debugf("not using the store for %s, the source has no MD5", name)
+		return updateCache(ctx, dest, source, name, bw)
+	}
+	fileName := dest.Abs(name)
+	object := s.path(hash)
+	if stored {
+		if info, err := os.Stat(fileName); err == nil {
+			if objectInfo, err := os.Stat(object); err == nil && os.SameFile(info, objectInfo) {
+				logrus.Debugf("%s is linked to the store", fileName)
+				events.emit(event{Event: eventSkip, File: name})
+				return nil
+			}
+		}
+		logrus.Debugf("linking %s to %s", fileName, object)
+		if err := linkObject(object, fileName); err != nil {
+			return fmt.Errorf("could not link %s to the store: %v", fileName, err)
+		}
+		events.emit(event{Event: eventSkip, File: name})
+		return nil
+	}
+
+	if localHash, err := dest.MD5(name); err == nil && localHash == hash {
+		logrus.Debugf("local copy is up to date")
+		events.emit(event{Event: eventSkip, File: name})
+	} else {
+		h := md5.New()
+		if err := fetch(ctx, dest, source, name, bw, h); err != nil {
+			return err
+		}
+		if localHash := hex.EncodeToString(h.Sum(nil)); localHash != hash {
+			logrus.Warnf("not adding %s to the store, its MD5 is %s instead of %s", fileName, localHash, hash)
+			return nil
+		}
+	}
+	if err := s.add(fileName, hash); err != nil {
+		logrus.Warnf("could not add %s to the store: %v", fileName, err)
+	}
+	return nil
+}
+
+// add moves the file with the given MD5 to the store, leaving a link in its
+// place: a hard link if possible, or a symbolic link otherwise.
+func (s contentStore) add(fileName, hash string) error {
+	object := s.path(hash)
+	if err := os.MkdirAll(filepath.Dir(object), os.ModePerm); err != nil {
+		return err
+	}
+	if err := os.Link(fileName, object); err == nil || os.IsExist(err) {
+		if err != nil {
+			// Another job stored the same file meanwhile.
+			return linkObject(object, fileName)
+		}
+		return nil
+	}
+
+	// The store is in another device, copy the file and link to it.
+	tmp := object + ".tmp"
+	if err := copyLocalFile(fileName, tmp); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, object); err != nil {
+		return err
+	}
+	return linkObject(object, fileName)
+}
+
+// linkObject replaces fileName with a link to an object of the store.
+func linkObject(object, fileName string) error {
+	if err := os.MkdirAll(filepath.Dir(fileName), os.ModePerm); err != nil {
+		return err
+	}
+	tmp := fileName + ".tmp"
+	_ = os.Remove(tmp)
+	if err := os.Link(object, tmp); err != nil {
+		abs, err := filepath.Abs(object)
+		if err != nil {
+			return err
+		}
+		if err := os.Symlink(abs, tmp); err != nil {
+			return err
+		}
+	}
+	return os.Rename(tmp, fileName)
+}
+
+func copyLocalFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
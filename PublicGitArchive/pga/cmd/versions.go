@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"github.com/src-d/datasets/PublicGitArchive/pga/pga"
+)
+
+const (
+	latestVersion = "latest"
+	catalogName   = "versions.json"
+)
+
+// versionCatalog lists the versions of a dataset available in the server.
+type versionCatalog struct {
+	Latest   string        `json:"latest"`
+	Versions []versionInfo `json:"versions"`
+}
+
+type versionInfo struct {
+	Name        string `json:"name"`
+	Date        string `json:"date,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// errNoCatalog is returned when the server has no version catalog for a
+// dataset.
+var errNoCatalog = errors.New("the server has no version catalog")
+
+// getCatalog returns the version catalog of a dataset. The cached copy is
+// used if it was checked against the server less than maxAge ago, or when the
+// server can not be reached. A catalog missing in the server is not looked
+// for again before maxAge either.
+func getCatalog(ctx context.Context, datasetName string, maxAge time.Duration) (*versionCatalog, error) {
+	dest, err := indexCache(datasetName)
+	if err != nil {
+		return nil, err
+	}
+	source, err := indexSource(datasetName)
+	if err != nil {
+		return nil, err
+	}
+	_, cerr := dest.Size(catalogName)
+	cached := cerr == nil
+	if t, err := lastChecked(dest, catalogName); err == nil && time.Since(t) < maxAge {
+		if !cached {
+			return nil, errNoCatalog
+		}
+		logrus.Debugf("using the cached version catalog of %s, checked at %s", datasetName, t)
+	} else if _, err := source.Size(catalogName); os.IsNotExist(err) {
+		if cached {
+			if err := dest.Remove(catalogName); err != nil {
+				return nil, err
+			}
+		}
+		markChecked(dest, catalogName)
+		return nil, errNoCatalog
+	} else if err := updateCache(ctx, dest, source, catalogName, nil); err != nil {
+		if _, cancel := err.(*pga.CommandCanceledError); cancel {
+			return nil, err
+		}
+		if !cached {
+			return nil, fmt.Errorf("could not get the version catalog: %v", err)
+		}
+		logrus.Warnf("could not update the version catalog, using the cached one: %v", err)
+	} else {
+		markChecked(dest, catalogName)
+	}
+
+	rc, err := dest.Open(catalogName)
+	if err != nil {
+		return nil, fmt.Errorf("could not open the version catalog: %v", err)
+	}
+	defer rc.Close()
+	b, err := ioutil.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	var catalog versionCatalog
+	if err := json.Unmarshal(b, &catalog); err != nil {
+		return nil, fmt.Errorf("could not parse the version catalog: %v", err)
+	}
+	return &catalog, nil
+}
+
+// resolveVersion sets the version used for the given dataset, as returned by
+// datasetVersion.
+func resolveVersion(ctx context.Context, datasetName string) {
+	pgaVersion = datasetVersion(ctx, datasetName)
+	indexName = pgaVersion + indexSuffix
+}
+
+// datasetVersion returns the version to use for the given dataset. An
+// explicit --pga-version always wins, then the version pinned in the
+// configuration, then the pga-version setting of the configuration, and
+// finally latest, which is resolved to a concrete version through the catalog
+// if possible.
+func datasetVersion(ctx context.Context, datasetName string) string {
+	version := requestedVersion
+	if !pgaVersionSet && pgaConfig != nil {
+		if pinned, ok := pgaConfig.Pin[datasetName]; ok {
+			logrus.Debugf("using %s version %s pinned in the configuration", datasetName, pinned)
+			version = pinned
+		}
+	}
+
+	if version == latestVersion {
+		catalog, err := getCatalog(ctx, datasetName, checkInterval)
+		if err == errNoCatalog {
+			logrus.Debugf("%s has no version catalog, using %s", datasetName, latestVersion)
+		} else if err != nil {
+			logrus.Warnf("could not resolve the latest version of %s, using %s: %v", datasetName, latestVersion, err)
+		} else if catalog.Latest == "" {
+			logrus.Warnf("the version catalog of %s has no latest version, using %s", datasetName, latestVersion)
+		} else {
+			version = catalog.Latest
+		}
+	}
+
+	if version != latestVersion {
+		logrus.Infof("using %s dataset version %s", datasetName, version)
+	}
+	return version
+}
+
+// versionsCmd represents the versions command
+var versionsCmd = &cobra.Command{
+	Use:   "versions",
+	Short: "list the available versions of a dataset",
+	Long: `Lists the versions of a dataset available in the server.
+
+With --pin, the given version, or the latest one if none is given, is pinned in the
+project configuration file (.pga.yaml) so that every command run under that
+directory uses it unless --pga-version is given.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		flags := cmd.Flags()
+		if flags.NArg() < 1 || flags.NArg() > 2 {
+			return fmt.Errorf("usage: pga versions <dataset> [version]")
+		}
+		dataset, err := datasetByName(flags.Arg(0))
+		if err != nil {
+			return err
+		}
+		pin, err := flags.GetBool("pin")
+		if err != nil {
+			return err
+		}
+		ctx := setupContext()
+		catalog, err := getCatalog(ctx, dataset.Name(), 0)
+		if err != nil {
+			return err
+		}
+		config, path, err := loadProjectConfig()
+		if err != nil {
+			return err
+		}
+
+		if pin {
+			version := catalog.Latest
+			if flags.NArg() == 2 {
+				version = flags.Arg(1)
+			}
+			if !catalog.has(version) {
+				return fmt.Errorf("unknown %s version: %s", dataset.Name(), version)
+			}
+			if config.Pin == nil {
+				config.Pin = map[string]string{}
+			}
+			config.Pin[dataset.Name()] = version
+			if err := config.save(path); err != nil {
+				return fmt.Errorf("could not write %s: %v", path, err)
+			}
+			fmt.Printf("pinned %s version %s in %s\n", dataset.Name(), version, path)
+			return nil
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tDATE\tLATEST\tPINNED\tDESCRIPTION")
+		for _, v := range catalog.Versions {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.Name, v.Date,
+				mark(v.Name == catalog.Latest), mark(v.Name == config.Pin[dataset.Name()]),
+				v.Description)
+		}
+		return w.Flush()
+	},
+}
+
+func (c *versionCatalog) has(version string) bool {
+	for _, v := range c.Versions {
+		if v.Name == version {
+			return true
+		}
+	}
+	return false
+}
+
+func mark(b bool) string {
+	if b {
+		return "*"
+	}
+	return ""
+}
+
+func init() {
+	RootCmd.AddCommand(versionsCmd)
+	versionsCmd.Flags().Bool("pin", false, "pin the version in the project configuration file")
+}
@@ -5,13 +5,20 @@ go 1.12
 require (
 	github.com/cheggaaa/pb/v3 v3.0.1
 	github.com/colinmarc/hdfs v1.1.3
+	github.com/dustin/go-humanize v1.0.0
+	github.com/go-enry/go-enry/v2 v2.7.2
+	github.com/go-enry/go-license-detector/v4 v4.3.0
 	github.com/golang/protobuf v1.3.2 // indirect
-	github.com/pkg/errors v0.8.1
+	github.com/hhatto/gocloc v0.4.2
+	github.com/pkg/errors v0.9.1
 	github.com/sirupsen/logrus v1.4.2
 	github.com/spf13/cobra v0.0.5
 	github.com/spf13/pflag v1.0.5
+	github.com/xitongsys/parquet-go v1.5.1
+	golang.org/x/crypto v0.0.0-20200302210943-78000ba7a073
 	gopkg.in/src-d/go-billy-siva.v4 v4.6.0
 	gopkg.in/src-d/go-billy.v4 v4.3.2
 	gopkg.in/src-d/go-git.v4 v4.13.1
 	gopkg.in/src-d/go-siva.v1 v1.8.0
+	gopkg.in/yaml.v2 v2.2.8
 )
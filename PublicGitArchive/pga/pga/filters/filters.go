@@ -4,6 +4,7 @@ package filters
 
 import (
 	"fmt"
+	"math"
 	"regexp"
 	"strings"
 
@@ -55,3 +56,65 @@ func URLRegexp(s string) (pga.Filter, error) {
 	}
 	return func(r pga.Repository) bool { return re.MatchString(r.GetURL()) }, nil
 }
+
+// MinFileExtractionRate returns a Filter that matches the UAST repositories
+// where at least the given ratio of files was parsed.
+func MinFileExtractionRate(rate float64) pga.Filter {
+	return uastFilter(func(r *pga.UastRepository) bool { return r.FileExtractionRate >= rate })
+}
+
+// MinByteExtractionRate returns a Filter that matches the UAST repositories
+// where at least the given ratio of bytes was parsed.
+func MinByteExtractionRate(rate float64) pga.Filter {
+	return uastFilter(func(r *pga.UastRepository) bool { return r.ByteExtractionRate >= rate })
+}
+
+// MinLanguageFileExtractionRate returns a Filter that matches the UAST
+// repositories where at least the given ratio of files of a language was parsed.
+func MinLanguageFileExtractionRate(lang string, rate float64) pga.Filter {
+	return uastLanguageFilter(lang, func(r *pga.UastRepository, i int) bool {
+		return i < len(r.LanguagesFileExtractionRate) && r.LanguagesFileExtractionRate[i] >= rate
+	})
+}
+
+// MinLanguageByteExtractionRate returns a Filter that matches the UAST
+// repositories where at least the given ratio of bytes of a language was parsed.
+func MinLanguageByteExtractionRate(lang string, rate float64) pga.Filter {
+	return uastLanguageFilter(lang, func(r *pga.UastRepository, i int) bool {
+		return i < len(r.LanguagesByteExtractionRate) && r.LanguagesByteExtractionRate[i] >= rate
+	})
+}
+
+// MinLanguageParsedFiles returns a Filter that matches the UAST repositories
+// with at least the given number of parsed files of a language.
+func MinLanguageParsedFiles(lang string, files int64) pga.Filter {
+	return uastLanguageFilter(lang, func(r *pga.UastRepository, i int) bool {
+		if i >= len(r.LanguagesFileCount) || i >= len(r.LanguagesFileExtractionRate) {
+			return false
+		}
+		parsed := math.Round(float64(r.LanguagesFileCount[i]) * r.LanguagesFileExtractionRate[i])
+		return int64(parsed) >= files
+	})
+}
+
+// uastFilter returns a Filter that never matches repositories of other datasets.
+func uastFilter(f func(r *pga.UastRepository) bool) pga.Filter {
+	return func(r pga.Repository) bool {
+		ur, ok := r.(*pga.UastRepository)
+		return ok && f(ur)
+	}
+}
+
+// uastLanguageFilter returns a Filter that calls f with the index of the
+// language in the stats of a UAST repository, if it has it.
+func uastLanguageFilter(lang string, f func(r *pga.UastRepository, i int) bool) pga.Filter {
+	lang = strings.ToLower(lang)
+	return uastFilter(func(r *pga.UastRepository) bool {
+		for i, l := range r.Languages {
+			if strings.ToLower(l) == lang {
+				return f(r, i)
+			}
+		}
+		return false
+	})
+}
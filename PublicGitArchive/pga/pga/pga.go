@@ -15,6 +15,7 @@ type Repository interface {
 	GetURL() string
 	GetLanguages() []string
 	GetFilenames() []string
+	GetSize() int64
 }
 
 // A Filter provides a way to filter repositories.
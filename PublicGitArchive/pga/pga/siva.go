@@ -38,6 +38,11 @@ var sivaCSVHeaders = []string{
 	sivaHeaderSize:              "SIZE",
 }
 
+// SivaCSVHeaders returns the names of the columns of the CSV index.
+func SivaCSVHeaders() []string {
+	return append([]string(nil), sivaCSVHeaders...)
+}
+
 // SivaRepository contains the data from a row of the CSV index
 type SivaRepository struct {
 	URL           string   `json:"url"`           // URL of the repository.
@@ -99,6 +104,11 @@ func (r *SivaRepository) GetFilenames() []string {
 	return r.SivaFilenames
 }
 
+// GetSize returns the sum of the sizes of the files of the repository, or -1 if unknown.
+func (r *SivaRepository) GetSize() int64 {
+	return r.Size
+}
+
 // RepositoryFromTuple returns a SivaRepository from a slice of strings corresponding to it's CSV representation.
 func (dataset *SivaDataset) RepositoryFromTuple(cols []string) (repo Repository, err error) {
 	if !dataset.hasStars {
@@ -0,0 +1,313 @@
+// Package sivarepo opens the siva files of Public Git Archive as go-git
+// repositories.
+//
+// Each siva file holds a rooted repository: the objects of one or more
+// repositories sharing their history, with every reference suffixed by the
+// UUID of the repository it belongs to and the URLs of each repository in a
+// remote named after its UUID. An Archive gives access to the rooted
+// repository and to a read-only view of each contained repository, with its
+// references named as in the original repository.
+package sivarepo
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	sivafs "gopkg.in/src-d/go-billy-siva.v4"
+	billy "gopkg.in/src-d/go-billy.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/storer"
+	gitstorage "gopkg.in/src-d/go-git.v4/storage"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+)
+
+// HeadPrefix is the prefix of the references pointing to the HEAD of each
+// repository in a rooted repository, followed by the repository UUID.
+const HeadPrefix = "refs/heads/HEAD/"
+
+var (
+	// ErrRepositoryNotFound is returned when a siva file does not hold the
+	// requested repository.
+	ErrRepositoryNotFound = errors.New("repository not found")
+	// ErrReadOnly is returned when modifying the references or the
+	// configuration of a repository of a siva file.
+	ErrReadOnly = errors.New("the repositories of a siva file are read only")
+)
+
+// Archive is the rooted repository stored in a siva file.
+type Archive struct {
+	// Rooted holds the objects and the references of all the repositories.
+	Rooted *git.Repository
+
+	fs sivafs.SivaFS
+}
+
+// Open opens the siva file at path in fs read-only. The archive must be
+// closed to release the siva file.
+func Open(fs billy.Filesystem, path string) (*Archive, error) {
+	if _, err := fs.Stat(path); err != nil {
+		return nil, err
+	}
+	sfs, err := sivafs.NewFilesystemReadOnly(fs, path, 0)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create a siva filesystem from %s: %v", path, err)
+	}
+	s := filesystem.NewStorage(sfs, cache.NewObjectLRUDefault())
+	if s == nil {
+		_ = sfs.Sync()
+		return nil, fmt.Errorf("unable to create a new storage backend from %s", path)
+	}
+	repo, err := git.Open(s, nil)
+	if err != nil {
+		_ = sfs.Sync()
+		return nil, fmt.Errorf("unable to open the Git repository from %s: %v", path, err)
+	}
+	return &Archive{Rooted: repo, fs: sfs}, nil
+}
+
+// Close releases the siva file of the archive.
+func (a *Archive) Close() error {
+	if a.fs == nil {
+		return nil
+	}
+	return a.fs.Sync()
+}
+
+// OpenFile opens a siva file of the local file system.
+func OpenFile(path string) (*Archive, error) {
+	return Open(osfs.New(filepath.Dir(path)), filepath.Base(path))
+}
+
+// Read reads a whole siva file into memory and opens it. It allows to open
+// the siva files of any storage, such as HDFS or HTTP.
+func Read(r io.Reader) (*Archive, error) {
+	const name = "repository.siva"
+	fs := memfs.New()
+	f, err := fs.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("unable to read the siva file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	return Open(fs, name)
+}
+
+// Repository is one of the repositories of an Archive. Its references are
+// named as in the original repository, e.g. refs/heads/master, and HEAD
+// points to the branch of the original HEAD, master if several match. The
+// remote URLs are in the origin remote of its configuration.
+type Repository struct {
+	*git.Repository
+	// ID is the UUID of the repository in the siva file.
+	ID string
+	// URLs are the remote URLs of the repository.
+	URLs []string
+}
+
+// Repositories returns the repositories of the archive, found both in its
+// remotes and in its HEAD references, sorted by ID.
+func (a *Archive) Repositories() ([]*Repository, error) {
+	cfg, err := a.Rooted.Config()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the config: %v", err)
+	}
+	ids := map[string]bool{}
+	for id := range cfg.Remotes {
+		ids[id] = true
+	}
+	refs, err := a.Rooted.References()
+	if err != nil {
+		return nil, fmt.Errorf("unable to list Git references: %v", err)
+	}
+	err = refs.ForEach(func(ref *plumbing.Reference) error {
+		if name := ref.Name().String(); strings.HasPrefix(name, HeadPrefix) {
+			ids[name[len(HeadPrefix):]] = true
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to list Git references: %v", err)
+	}
+
+	sorted := make([]string, 0, len(ids))
+	for id := range ids {
+		sorted = append(sorted, id)
+	}
+	sort.Strings(sorted)
+	repos := make([]*Repository, 0, len(sorted))
+	for _, id := range sorted {
+		repo, err := a.open(id, cfg)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, repo)
+	}
+	return repos, nil
+}
+
+// Repository returns the repository with the given UUID or remote URL, or
+// ErrRepositoryNotFound.
+func (a *Archive) Repository(idOrURL string) (*Repository, error) {
+	cfg, err := a.Rooted.Config()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the config: %v", err)
+	}
+	if _, ok := cfg.Remotes[idOrURL]; ok {
+		return a.open(idOrURL, cfg)
+	}
+	for id, remote := range cfg.Remotes {
+		for _, u := range remote.URLs {
+			if u == idOrURL {
+				return a.open(id, cfg)
+			}
+		}
+	}
+	if _, err := a.Rooted.Reference(plumbing.ReferenceName(HeadPrefix+idOrURL), false); err == nil {
+		return a.open(idOrURL, cfg)
+	}
+	return nil, ErrRepositoryNotFound
+}
+
+func (a *Archive) open(id string, cfg *config.Config) (*Repository, error) {
+	var urls []string
+	if remote, ok := cfg.Remotes[id]; ok {
+		urls = remote.URLs
+	}
+	repo, err := git.Open(&storage{Storer: a.Rooted.Storer, id: id, urls: urls}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open the repository %s: %v", id, err)
+	}
+	return &Repository{Repository: repo, ID: id, URLs: urls}, nil
+}
+
+// storage shows the storage of a rooted repository as one of its
+// repositories, renaming its references and hiding the others.
+type storage struct {
+	gitstorage.Storer
+	id   string
+	urls []string
+}
+
+// references returns the references of the repository renamed back, and the
+// hash of its HEAD, zero if it has none.
+func (s *storage) references() ([]*plumbing.Reference, plumbing.Hash, error) {
+	iter, err := s.Storer.IterReferences()
+	if err != nil {
+		return nil, plumbing.ZeroHash, err
+	}
+	var (
+		refs []*plumbing.Reference
+		head plumbing.Hash
+	)
+	suffix := "/" + s.id
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if ref.Type() != plumbing.HashReference || !strings.HasSuffix(name, suffix) {
+			return nil
+		}
+		if name == HeadPrefix+s.id {
+			head = ref.Hash()
+			return nil
+		}
+		name = strings.TrimSuffix(name, suffix)
+		refs = append(refs, plumbing.NewHashReference(plumbing.ReferenceName(name), ref.Hash()))
+		return nil
+	})
+	if err != nil {
+		return nil, plumbing.ZeroHash, err
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].Name() < refs[j].Name() })
+	return refs, head, nil
+}
+
+// head returns the HEAD of the repository: a symbolic reference to the
+// branch pointing to the same commit as the original HEAD, master if
+// possible, or the commit itself if no branch does. Without HEAD it points
+// to master, as in an empty repository.
+func head(refs []*plumbing.Reference, hash plumbing.Hash) *plumbing.Reference {
+	if hash.IsZero() {
+		return plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master)
+	}
+	var target plumbing.ReferenceName
+	for _, ref := range refs {
+		if !ref.Name().IsBranch() || ref.Hash() != hash {
+			continue
+		}
+		if target == "" || ref.Name() == plumbing.Master {
+			target = ref.Name()
+		}
+	}
+	if target == "" {
+		return plumbing.NewHashReference(plumbing.HEAD, hash)
+	}
+	return plumbing.NewSymbolicReference(plumbing.HEAD, target)
+}
+
+func (s *storage) Reference(name plumbing.ReferenceName) (*plumbing.Reference, error) {
+	if name == plumbing.HEAD {
+		refs, hash, err := s.references()
+		if err != nil {
+			return nil, err
+		}
+		return head(refs, hash), nil
+	}
+	if name.String()+"/" == HeadPrefix {
+		return nil, plumbing.ErrReferenceNotFound
+	}
+	ref, err := s.Storer.Reference(plumbing.ReferenceName(name.String() + "/" + s.id))
+	if err != nil {
+		return nil, err
+	}
+	if ref.Type() != plumbing.HashReference {
+		return nil, plumbing.ErrReferenceNotFound
+	}
+	return plumbing.NewHashReference(name, ref.Hash()), nil
+}
+
+func (s *storage) IterReferences() (storer.ReferenceIter, error) {
+	refs, hash, err := s.references()
+	if err != nil {
+		return nil, err
+	}
+	return storer.NewReferenceSliceIter(append([]*plumbing.Reference{head(refs, hash)}, refs...)), nil
+}
+
+func (s *storage) CountLooseRefs() (int, error) {
+	refs, _, err := s.references()
+	return len(refs), err
+}
+
+func (s *storage) SetReference(*plumbing.Reference) error              { return ErrReadOnly }
+func (s *storage) CheckAndSetReference(_, _ *plumbing.Reference) error { return ErrReadOnly }
+func (s *storage) RemoveReference(plumbing.ReferenceName) error        { return ErrReadOnly }
+func (s *storage) PackRefs() error                                     { return ErrReadOnly }
+func (s *storage) SetConfig(*config.Config) error                      { return ErrReadOnly }
+
+// Config returns a configuration with the URLs of the repository in the
+// origin remote.
+func (s *storage) Config() (*config.Config, error) {
+	cfg := config.NewConfig()
+	cfg.Core.IsBare = true
+	if len(s.urls) > 0 {
+		cfg.Remotes[git.DefaultRemoteName] = &config.RemoteConfig{
+			Name:  git.DefaultRemoteName,
+			URLs:  s.urls,
+			Fetch: []config.RefSpec{config.RefSpec("+refs/heads/*:refs/remotes/origin/*")},
+		}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,312 @@
+package sivarepo
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	sivafs "gopkg.in/src-d/go-billy-siva.v4"
+	"gopkg.in/src-d/go-billy.v4/memfs"
+	"gopkg.in/src-d/go-billy.v4/osfs"
+	"gopkg.in/src-d/go-git.v4"
+	"gopkg.in/src-d/go-git.v4/config"
+	"gopkg.in/src-d/go-git.v4/plumbing"
+	"gopkg.in/src-d/go-git.v4/plumbing/cache"
+	"gopkg.in/src-d/go-git.v4/plumbing/object"
+	"gopkg.in/src-d/go-git.v4/storage/filesystem"
+	"gopkg.in/src-d/go-git.v4/storage/memory"
+)
+
+const testID = "0168e2c7-ef60-4c3f-9a56-d5a1b0a8d6a7"
+
+var testURLs = []string{"https://github.com/src-d/go-git", "git://github.com/src-d/go-git"}
+
+// rootedArchive builds a rooted repository holding a single repository with
+// a master and a dev branch on the same commit, a tag and a HEAD, all
+// suffixed with its UUID.
+func rootedArchive(t *testing.T) (*Archive, plumbing.Hash) {
+	fs := memfs.New()
+	rooted, err := git.Init(memory.NewStorage(), fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := rooted.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := fs.Create("README")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("hello\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add("README"); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := w.Commit("initial commit", &git.CommitOptions{
+		Author: &object.Signature{Name: "pga", Email: "pga@example.com", When: time.Unix(0, 0)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"refs/heads/master", "refs/heads/dev", "refs/heads/HEAD", "refs/tags/v1"} {
+		ref := plumbing.NewHashReference(plumbing.ReferenceName(name+"/"+testID), hash)
+		if err := rooted.Storer.SetReference(ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := rooted.Storer.RemoveReference(plumbing.Master); err != nil {
+		t.Fatal(err)
+	}
+	_, err = rooted.CreateRemote(&config.RemoteConfig{Name: testID, URLs: testURLs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Archive{Rooted: rooted}, hash
+}
+
+// writeSiva writes the objects, the references and the configuration of a
+// rooted repository to a new siva file.
+func writeSiva(t *testing.T, rooted *git.Repository, path string) {
+	sfs, err := sivafs.NewFilesystem(osfs.New(filepath.Dir(path)), filepath.Base(path), memfs.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := filesystem.NewStorage(sfs, cache.NewObjectLRUDefault())
+	objects, err := rooted.Storer.IterEncodedObjects(plumbing.AnyObject)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = objects.ForEach(func(obj plumbing.EncodedObject) error {
+		_, err := s.SetEncodedObject(obj)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	refs, err := rooted.Storer.IterReferences()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := refs.ForEach(s.SetReference); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := rooted.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := sfs.Sync(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOpenFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sivarepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, hash := rootedArchive(t)
+	path := filepath.Join(dir, "rooted.siva")
+	writeSiva(t, a.Rooted, path)
+	if err := os.Chmod(path, 0444); err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := OpenFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	repo, err := archive.Repository(testURLs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.ID != testID {
+		t.Errorf("expected ID %s, got %s", testID, repo.ID)
+	}
+	ref, err := repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Name() != plumbing.Master || ref.Hash() != hash {
+		t.Errorf("expected HEAD to resolve to master at %s, got %s", hash, ref)
+	}
+	commit, err := repo.CommitObject(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if commit.Message != "initial commit" {
+		t.Errorf("unexpected commit message %q", commit.Message)
+	}
+	if err := archive.Close(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOpenFileMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sivarepo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "missing.siva")
+	if _, err := OpenFile(path); err == nil {
+		t.Fatal("expected an error opening a missing siva file")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected %s not to be created, got %v", path, err)
+	}
+}
+
+func TestRepositories(t *testing.T) {
+	a, _ := rootedArchive(t)
+	repos, err := a.Repositories()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(repos) != 1 {
+		t.Fatalf("expected 1 repository, got %d", len(repos))
+	}
+	if repos[0].ID != testID {
+		t.Errorf("expected ID %s, got %s", testID, repos[0].ID)
+	}
+	if !reflect.DeepEqual(repos[0].URLs, testURLs) {
+		t.Errorf("expected URLs %v, got %v", testURLs, repos[0].URLs)
+	}
+}
+
+func TestRepository(t *testing.T) {
+	a, _ := rootedArchive(t)
+	for _, idOrURL := range append([]string{testID}, testURLs...) {
+		repo, err := a.Repository(idOrURL)
+		if err != nil {
+			t.Fatalf("%s: %v", idOrURL, err)
+		}
+		if repo.ID != testID {
+			t.Errorf("%s: expected ID %s, got %s", idOrURL, testID, repo.ID)
+		}
+	}
+	if _, err := a.Repository("https://github.com/src-d/unknown"); err != ErrRepositoryNotFound {
+		t.Errorf("expected %v, got %v", ErrRepositoryNotFound, err)
+	}
+}
+
+func TestReferences(t *testing.T) {
+	a, hash := rootedArchive(t)
+	repo, err := a.Repository(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []plumbing.ReferenceName{"refs/heads/master", "refs/heads/dev", "refs/tags/v1"} {
+		ref, err := repo.Reference(name, false)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if ref.Name() != name || ref.Hash() != hash {
+			t.Errorf("%s: unexpected reference %s", name, ref)
+		}
+	}
+	if _, err := repo.Reference("refs/heads/HEAD", false); err != plumbing.ErrReferenceNotFound {
+		t.Errorf("expected %v for the HEAD branch, got %v", plumbing.ErrReferenceNotFound, err)
+	}
+
+	ref, err := repo.Reference(plumbing.HEAD, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Type() != plumbing.SymbolicReference || ref.Target() != plumbing.Master {
+		t.Errorf("expected HEAD to point to master, got %s", ref)
+	}
+	ref, err = repo.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref.Hash() != hash {
+		t.Errorf("expected HEAD to resolve to %s, got %s", hash, ref.Hash())
+	}
+	if _, err := repo.CommitObject(hash); err != nil {
+		t.Errorf("unable to read the HEAD commit: %v", err)
+	}
+
+	iter, err := repo.References()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	err = iter.ForEach(func(ref *plumbing.Reference) error {
+		names = append(names, ref.Name().String())
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"HEAD", "refs/heads/dev", "refs/heads/master", "refs/tags/v1"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected references %v, got %v", expected, names)
+	}
+
+	if err := repo.Storer.SetReference(plumbing.NewHashReference("refs/heads/new", hash)); err != ErrReadOnly {
+		t.Errorf("expected %v, got %v", ErrReadOnly, err)
+	}
+}
+
+func TestConfig(t *testing.T) {
+	a, _ := rootedArchive(t)
+	repo, err := a.Repository(testID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := repo.Config()
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote, ok := cfg.Remotes[git.DefaultRemoteName]
+	if !ok {
+		t.Fatal("expected an origin remote")
+	}
+	if !reflect.DeepEqual(remote.URLs, testURLs) {
+		t.Errorf("expected URLs %v, got %v", testURLs, remote.URLs)
+	}
+}
+
+func TestHead(t *testing.T) {
+	hash := plumbing.NewHash("d8f2fc2d1d6ac8a2bd7e4b8a5c1b2f0e9a4c3b21")
+	other := plumbing.NewHash("0b0b1f6cf0ad3e7bd0d3bea2c2cf2df4a0ca3c4e")
+	refs := []*plumbing.Reference{
+		plumbing.NewHashReference("refs/heads/dev", hash),
+		plumbing.NewHashReference("refs/heads/feature", other),
+		plumbing.NewHashReference("refs/tags/v1", hash),
+	}
+
+	testCases := []struct {
+		name     string
+		refs     []*plumbing.Reference
+		hash     plumbing.Hash
+		expected *plumbing.Reference
+	}{
+		{"no HEAD", refs, plumbing.ZeroHash, plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master)},
+		{"single branch", refs, other, plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/feature")},
+		{"first branch", refs, hash, plumbing.NewSymbolicReference(plumbing.HEAD, "refs/heads/dev")},
+		{"master preferred", append(refs, plumbing.NewHashReference(plumbing.Master, hash)), hash,
+			plumbing.NewSymbolicReference(plumbing.HEAD, plumbing.Master)},
+		{"no branch", refs[2:], hash, plumbing.NewHashReference(plumbing.HEAD, hash)},
+	}
+	for _, tc := range testCases {
+		if ref := head(tc.refs, tc.hash); ref.String() != tc.expected.String() {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, ref)
+		}
+	}
+}
@@ -28,6 +28,11 @@ var uastCSVHeaders = []string{
 	uastHeaderLangsByteExtractionRate: "LANGS_BYTE_EXTRACT_RATE",
 }
 
+// UastCSVHeaders returns the names of the columns of the CSV index.
+func UastCSVHeaders() []string {
+	return append([]string(nil), uastCSVHeaders...)
+}
+
 // UastRepository contains the data from a row of the CSV index
 type UastRepository struct {
 	URL              string   `json:"url"`              // URL of the repository.
@@ -79,6 +84,11 @@ func (r *UastRepository) GetFilenames() []string {
 	return r.ParquetFilenames
 }
 
+// GetSize returns the sum of the sizes of the files of the repository, or -1 if unknown.
+func (r *UastRepository) GetSize() int64 {
+	return r.Size
+}
+
 // UastDataset provides iteration over the SivaRepositories.
 type UastDataset struct{}
 